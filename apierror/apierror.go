@@ -0,0 +1,188 @@
+package apierror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"jt-api/config"
+	"jt-api/logger"
+	"net/http"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Code is a machine readable error code, clients should rely on codes rather
+// than messages which are localized
+type Code string
+
+// Error codes
+const (
+	BadRequest         Code = "bad_request"
+	InvalidID          Code = "invalid_id"
+	InvalidBody        Code = "invalid_body"
+	InvalidPage        Code = "invalid_page"
+	InvalidSort        Code = "invalid_sort"
+	InvalidTag         Code = "invalid_tag"
+	InvalidImage       Code = "invalid_image"
+	InvalidParameter   Code = "invalid_parameter"
+	MissingFields      Code = "missing_fields"
+	ValidationFailed   Code = "validation_failed"
+	SelfFollow         Code = "self_follow"
+	Unauthorized       Code = "unauthorized"
+	InvalidCredentials Code = "invalid_credentials"
+	Forbidden          Code = "forbidden"
+	NotFound           Code = "not_found"
+	UserNotFound       Code = "user_not_found"
+	PostNotFound       Code = "post_not_found"
+	CommentNotFound    Code = "comment_not_found"
+	CommunityNotFound  Code = "community_not_found"
+	UsernameTaken      Code = "username_taken"
+	EmailTaken         Code = "email_taken"
+	RateLimited        Code = "rate_limited"
+	LoginLocked        Code = "login_locked"
+	InvalidToken       Code = "invalid_token"
+	EmailNotVerified   Code = "email_not_verified"
+	EmailVerified      Code = "email_verified"
+	Internal           Code = "internal"
+)
+
+// statuses maps error codes to HTTP statuses, unknown codes are internal errors
+var statuses = map[Code]int{
+	BadRequest:         http.StatusBadRequest,
+	InvalidID:          http.StatusBadRequest,
+	InvalidBody:        http.StatusBadRequest,
+	InvalidPage:        http.StatusBadRequest,
+	InvalidSort:        http.StatusBadRequest,
+	InvalidTag:         http.StatusBadRequest,
+	InvalidImage:       http.StatusBadRequest,
+	InvalidParameter:   http.StatusBadRequest,
+	MissingFields:      http.StatusBadRequest,
+	ValidationFailed:   http.StatusBadRequest,
+	SelfFollow:         http.StatusBadRequest,
+	Unauthorized:       http.StatusUnauthorized,
+	InvalidCredentials: http.StatusUnauthorized,
+	Forbidden:          http.StatusForbidden,
+	NotFound:           http.StatusNotFound,
+	UserNotFound:       http.StatusNotFound,
+	PostNotFound:       http.StatusNotFound,
+	CommentNotFound:    http.StatusNotFound,
+	CommunityNotFound:  http.StatusNotFound,
+	UsernameTaken:      http.StatusConflict,
+	EmailTaken:         http.StatusConflict,
+	RateLimited:        http.StatusTooManyRequests,
+	LoginLocked:        http.StatusTooManyRequests,
+	InvalidToken:       http.StatusBadRequest,
+	EmailNotVerified:   http.StatusForbidden,
+	EmailVerified:      http.StatusConflict,
+	Internal:           http.StatusInternalServerError,
+}
+
+// DefaultLanguage is used when the language of the request is not known
+const DefaultLanguage = "tr"
+
+// Error is an error that is reported to the client as is
+type Error struct {
+	Code   Code
+	Fields []FieldError
+}
+
+// FieldError describes a field of the request body that failed a rule, Param
+// is the argument of the rule such as the maximum length
+type FieldError struct {
+	Field string `json:"field"`
+	Rule  string `json:"rule"`
+	Param string `json:"param,omitempty"`
+}
+
+// New creates an error with given code
+func New(code Code) *Error {
+	return &Error{Code: code}
+}
+
+func (err *Error) Error() string {
+	return string(err.Code)
+}
+
+// Status returns the HTTP status of the error
+func (err *Error) Status() int {
+	if status, ok := statuses[err.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// Response is the common response model of errors
+type Response struct {
+	Code      Code         `json:"code"`
+	Message   string       `json:"message"`
+	Fields    []FieldError `json:"fields,omitempty"`
+	RequestID string       `json:"requestId,omitempty"`
+}
+
+type contextKey int
+
+const languageKey contextKey = iota
+
+// WithLanguage attaches the language of the authenticated user to the request
+func WithLanguage(request *http.Request, language string) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), languageKey, language))
+}
+
+// Language returns the language errors are written in, the authenticated
+// user's language comes first and Accept-Language header second
+func Language(request *http.Request) string {
+	if language, ok := request.Context().Value(languageKey).(string); ok {
+		if _, ok := config.Languages[language]; ok {
+			return language
+		}
+	}
+
+	for _, part := range strings.Split(request.Header.Get("Accept-Language"), ",") {
+		tag := strings.TrimSpace(strings.SplitN(part, ";", 2)[0])
+		language := strings.ToLower(strings.SplitN(tag, "-", 2)[0])
+		if _, ok := config.Languages[language]; ok {
+			return language
+		}
+	}
+
+	return DefaultLanguage
+}
+
+// Write responds an error with given code
+func Write(response http.ResponseWriter, request *http.Request, code Code) {
+	write(response, request, New(code))
+}
+
+// WriteError responds given error, errors created by New are reported as is,
+// a missing document is reported as not found and anything else is logged
+// and reported as an internal error so database details do not leak
+func WriteError(response http.ResponseWriter, request *http.Request, err error) {
+	var apiErr *Error
+	switch {
+	case errors.As(err, &apiErr):
+	case errors.Is(err, mongo.ErrNoDocuments):
+		apiErr = New(NotFound)
+	default:
+		logger.FromRequest(request).Error("Request failed", "error", err)
+		apiErr = New(Internal)
+	}
+
+	write(response, request, apiErr)
+}
+
+func write(response http.ResponseWriter, request *http.Request, err *Error) {
+	message, ok := config.Languages[Language(request)].Errors[string(err.Code)]
+	if !ok {
+		message = string(err.Code)
+	}
+
+	response.Header().Set("content-type", "application/json; charset=utf-8")
+	response.WriteHeader(err.Status())
+	json.NewEncoder(response).Encode(Response{
+		Code:      err.Code,
+		Message:   message,
+		Fields:    err.Fields,
+		RequestID: logger.RequestID(request),
+	})
+}
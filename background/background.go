@@ -0,0 +1,43 @@
+package background
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// tasks tracks work that outlives the request that started it, such as
+// timeline fan-outs, so shutdown can wait for it
+var tasks sync.WaitGroup
+
+// Go runs task in its own goroutine and tracks it until it returns, a panic
+// is logged instead of bringing the server down
+func Go(task func()) {
+	tasks.Add(1)
+	go func() {
+		defer tasks.Done()
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				slog.Error("Background task panicked", "panic", recovered)
+			}
+		}()
+
+		task()
+	}()
+}
+
+// Wait blocks until every task returns or ctx is done
+func Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		tasks.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"jt-api/config"
+	"jt-api/edges"
+	"jt-api/logger"
+	"jt-api/service/counters"
+	"log/slog"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Copies upvotes, followers and members arrays into edge collections and
+// recomputes counters from the edges, run with the same environment as the
+// server. Arrays are only removed when -drop is given
+func main() {
+	drop := flag.Bool("drop", false, "remove embedded arrays after migrating")
+	conf, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		logger.Fatal("Failed to load configuration", err)
+	}
+	logger.Init(conf.Env, conf.LogLevel)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(conf.DatabaseURI))
+	if err != nil {
+		logger.Fatal("Failed to connect to database", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database(conf.DatabaseName)
+
+	if err = edges.Migrate(db); err != nil {
+		logger.Fatal("Failed to migrate edges", err)
+	}
+	slog.Info("Edges migrated")
+
+	if _, err = counters.Reconcile(context.Background(), db); err != nil {
+		logger.Fatal("Failed to reconcile counters", err)
+	}
+	slog.Info("Counters reconciled")
+
+	if *drop {
+		if err = edges.DropArrays(db); err != nil {
+			logger.Fatal("Failed to drop arrays", err)
+		}
+		slog.Info("Arrays dropped")
+	}
+}
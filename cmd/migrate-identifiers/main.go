@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"jt-api/config"
+	"jt-api/logger"
+	"jt-api/service/users"
+	"log/slog"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Fills the lowercase usernames and emails that logins and uniqueness checks
+// use, run with the same environment as the server. Users whose username or
+// email is taken by another user in a different case are listed and skipped,
+// run it again once they are renamed
+func main() {
+	conf, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		logger.Fatal("Failed to load configuration", err)
+	}
+	logger.Init(conf.Env, conf.LogLevel)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(conf.DatabaseURI))
+	if err != nil {
+		logger.Fatal("Failed to connect to database", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	migrated, collisions, err := users.MigrateIdentifiers(client.Database(conf.DatabaseName))
+	if err != nil {
+		logger.Fatal("Failed to migrate identifiers", err)
+	}
+	slog.Info("Identifiers migrated", "migrated", migrated)
+
+	for _, collision := range collisions {
+		slog.Warn("Identifier taken in another case", "user", collision.User.Hex(), "field", collision.Field, "value", collision.Value, "canonical", collision.Canonical)
+	}
+	if len(collisions) > 0 {
+		slog.Error("Some users were skipped, rename them and run again", "collisions", len(collisions))
+		os.Exit(1)
+	}
+}
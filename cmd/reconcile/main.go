@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"jt-api/config"
+	"jt-api/logger"
+	"jt-api/service/counters"
+	"log/slog"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Recomputes denormalized counters that drifted from the arrays and edges they
+// count, run with the same environment as the server
+func main() {
+	conf, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		logger.Fatal("Failed to load configuration", err)
+	}
+	logger.Init(conf.Env, conf.LogLevel)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(conf.DatabaseURI))
+	if err != nil {
+		logger.Fatal("Failed to connect to database", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	fixed, err := counters.Reconcile(context.Background(), client.Database(conf.DatabaseName))
+	for _, counter := range counters.Counters {
+		if modified, ok := fixed[counter]; ok {
+			slog.Info("Counter corrected", "collection", counter.Collection, "field", counter.Field, "modified", modified)
+		}
+	}
+	if err != nil {
+		logger.Fatal("Failed to reconcile counters", err)
+	}
+}
@@ -12,6 +12,14 @@ type Language struct {
 	PostComment    func(data string) string
 	CommentUpvote  func(data string) string
 	CommentMention func(data interface{}) string
+	LoginLocked    func() string
+	LoginLockedFor func(data string) string
+	VerifyEmail    func() string
+	VerifyEmailAt  func(data string) string
+	ResetPassword  func() string
+	ResetLinkAt    func(data string) string
+	// Errors are API error messages by error code
+	Errors map[string]string
 }
 
 // Languages is language data
@@ -47,6 +55,55 @@ var Languages = map[string]Language{
 		CommentMention: func(data interface{}) string {
 			return ""
 		},
+		LoginLocked: func() string {
+			return "Login Locked"
+		},
+		LoginLockedFor: func(data string) string {
+			return "Logins to your account are paused for " + data + " minutes after many failed attempts"
+		},
+		VerifyEmail: func() string {
+			return "Verify your email"
+		},
+		VerifyEmailAt: func(data string) string {
+			return "Welcome to Justhink! Open the link below to verify your email:\n\n" + data +
+				"\n\nIf you did not sign up, you can ignore this mail."
+		},
+		ResetPassword: func() string {
+			return "Reset your password"
+		},
+		ResetLinkAt: func(data string) string {
+			return "Open the link below to choose a new password, it can be used once:\n\n" + data +
+				"\n\nIf you did not ask for this, you can ignore this mail and your password stays the same."
+		},
+		Errors: map[string]string{
+			"bad_request":         "Bad request",
+			"invalid_id":          "Invalid ID",
+			"invalid_body":        "Request body is invalid",
+			"invalid_page":        "Invalid page or cursor",
+			"invalid_sort":        "Unknown sort",
+			"invalid_tag":         "Invalid tag",
+			"invalid_image":       "Image could not be read",
+			"invalid_parameter":   "Unknown parameter",
+			"missing_fields":      "Required fields are missing",
+			"validation_failed":   "Some fields are invalid",
+			"self_follow":         "Users can not follow themselves",
+			"unauthorized":        "Unauthorized",
+			"invalid_credentials": "Wrong username, email or password",
+			"forbidden":           "You are not allowed to do this",
+			"not_found":           "Not found",
+			"user_not_found":      "User not found",
+			"post_not_found":      "Post not found",
+			"comment_not_found":   "Comment not found",
+			"community_not_found": "Community not found",
+			"username_taken":      "Username is taken",
+			"email_taken":         "Email is already registered",
+			"rate_limited":        "Too many requests, try again later",
+			"login_locked":        "Too many failed logins, try again later",
+			"invalid_token":       "Link is invalid or expired",
+			"email_not_verified":  "Verify your email first",
+			"email_verified":      "Email is already verified",
+			"internal":            "Something went wrong",
+		},
 	},
 	"tr": {
 		FollowRequest: func(data string) string {
@@ -79,5 +136,54 @@ var Languages = map[string]Language{
 		CommentMention: func(data interface{}) string {
 			return ""
 		},
+		LoginLocked: func() string {
+			return "Giriş Kilitlendi"
+		},
+		LoginLockedFor: func(data string) string {
+			return "Çok sayıda hatalı denemeden sonra hesabına girişler " + data + " dakika durduruldu"
+		},
+		VerifyEmail: func() string {
+			return "E-postanı doğrula"
+		},
+		VerifyEmailAt: func(data string) string {
+			return "Justhink'e hoş geldin! E-postanı doğrulamak için aşağıdaki bağlantıyı aç:\n\n" + data +
+				"\n\nKaydolmadıysan bu e-postayı görmezden gelebilirsin."
+		},
+		ResetPassword: func() string {
+			return "Şifreni sıfırla"
+		},
+		ResetLinkAt: func(data string) string {
+			return "Yeni bir şifre seçmek için aşağıdaki bağlantıyı aç, bağlantı bir kez kullanılabilir:\n\n" + data +
+				"\n\nBunu sen istemediysen bu e-postayı görmezden gelebilirsin, şifren değişmez."
+		},
+		Errors: map[string]string{
+			"bad_request":         "Geçersiz istek",
+			"invalid_id":          "Geçersiz kimlik",
+			"invalid_body":        "İstek içeriği geçersiz",
+			"invalid_page":        "Geçersiz sayfa veya imleç",
+			"invalid_sort":        "Bilinmeyen sıralama",
+			"invalid_tag":         "Geçersiz etiket",
+			"invalid_image":       "Görsel okunamadı",
+			"invalid_parameter":   "Bilinmeyen parametre",
+			"missing_fields":      "Zorunlu alanlar eksik",
+			"validation_failed":   "Bazı alanlar geçersiz",
+			"self_follow":         "Kullanıcılar kendilerini takip edemez",
+			"unauthorized":        "Yetkisiz erişim",
+			"invalid_credentials": "Kullanıcı adı, e-posta veya şifre hatalı",
+			"forbidden":           "Bu işlem için yetkin yok",
+			"not_found":           "Bulunamadı",
+			"user_not_found":      "Kullanıcı bulunamadı",
+			"post_not_found":      "Paylaşım bulunamadı",
+			"comment_not_found":   "Yorum bulunamadı",
+			"community_not_found": "Topluluk bulunamadı",
+			"username_taken":      "Kullanıcı adı alınmış",
+			"email_taken":         "E-posta zaten kayıtlı",
+			"rate_limited":        "Çok fazla istek, daha sonra tekrar dene",
+			"login_locked":        "Çok fazla hatalı giriş, daha sonra tekrar dene",
+			"invalid_token":       "Bağlantı geçersiz veya süresi dolmuş",
+			"email_not_verified":  "Önce e-postanı doğrula",
+			"email_verified":      "E-posta zaten doğrulanmış",
+			"internal":            "Bir şeyler ters gitti",
+		},
 	},
 }
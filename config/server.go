@@ -0,0 +1,327 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"jt-api/logger"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Server is the configuration of the server and the commands sharing its
+// database
+type Server struct {
+	Env                 string
+	Port                int
+	DatabaseURI         string
+	DatabaseName        string
+	JWTSecret           string
+	AWSBucket           string
+	PostLimit           int
+	CommentLimit        int
+	FirebaseCredentials string
+	LogLevel            string
+
+	// ClientIPHeader is the header the proxy in front of the server puts the
+	// client IP in, such as X-Forwarded-For, empty when there is no proxy
+	ClientIPHeader string
+
+	// TraceExporter is where spans go, one of none, stdout and otlp,
+	// TraceEndpoint is the OTLP HTTP collector used by otlp
+	TraceExporter string
+	TraceEndpoint string
+
+	// Timeouts of the HTTP server, ShutdownTimeout bounds draining requests
+	// and background tasks on SIGTERM
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+
+	// QueryTimeout bounds operations on a few documents, BatchTimeout
+	// operations on many such as timeline fan-outs and QueryMaxTime the time
+	// the database spends on an aggregation
+	QueryTimeout time.Duration
+	BatchTimeout time.Duration
+	QueryMaxTime time.Duration
+
+	// DrainDelay is how long the server keeps serving while reporting not
+	// ready on SIGTERM, so load balancers stop routing to it first
+	DrainDelay time.Duration
+
+	// Mails are sent through the SMTP server at SMTPAddress, they are only
+	// logged when it is empty. A local sink such as Mailpit on
+	// localhost:1025 catches them in development
+	SMTPAddress  string
+	SMTPUsername string
+	SMTPPassword string
+	MailFrom     string
+
+	// AppURL is the address of the app links in mails point to
+	AppURL string
+
+	// EmailVerificationTTL is how long an email verification link is valid,
+	// RequireVerifiedEmail stops users without a verified email from posting
+	EmailVerificationTTL time.Duration
+	RequireVerifiedEmail bool
+
+	// PasswordResetTTL is how long a password reset link is valid
+	PasswordResetTTL time.Duration
+}
+
+// Defaults are used for settings that are not given
+var Defaults = Server{
+	Env:                 "dev",
+	Port:                8080,
+	DatabaseName:        "justhink",
+	AWSBucket:           "justhink",
+	PostLimit:           20,
+	CommentLimit:        20,
+	FirebaseCredentials: "./firebase-service-account-key.json",
+	LogLevel:            "info",
+	TraceExporter:       "none",
+	TraceEndpoint:       "localhost:4318",
+	ReadTimeout:         10 * time.Second,
+	WriteTimeout:        30 * time.Second,
+	IdleTimeout:         2 * time.Minute,
+	ShutdownTimeout:     30 * time.Second,
+	DrainDelay:          5 * time.Second,
+	QueryTimeout:        10 * time.Second,
+	BatchTimeout:        30 * time.Second,
+	QueryMaxTime:        2 * time.Second,
+	MailFrom:            "no-reply@justhink.net",
+	AppURL:              "https://justhink.net",
+
+	EmailVerificationTTL: 48 * time.Hour,
+	PasswordResetTTL:     time.Hour,
+}
+
+// DefaultFile is the settings file read when -config flag and CONFIG_FILE are
+// not given, it is fine for it to be missing
+const DefaultFile = ".env"
+
+// setting binds a field of Server to its environment variable, its flag is
+// the lower case name with dashes, e.g. POST_LIMIT is -post-limit
+type setting struct {
+	name   string
+	usage  string
+	target interface{}
+}
+
+func (server *Server) settings() []setting {
+	return []setting{
+		{"ENV", "environment, prod prints the banner", &server.Env},
+		{"PORT", "port to listen on", &server.Port},
+		{"DB_CONN_STR", "MongoDB connection string", &server.DatabaseURI},
+		{"DATABASE_NAME", "MongoDB database name", &server.DatabaseName},
+		{"JWT_SECRET", "secret signing auth tokens", &server.JWTSecret},
+		{"AWS_BUCKET", "S3 bucket of uploaded images", &server.AWSBucket},
+		{"POST_LIMIT", "posts per page", &server.PostLimit},
+		{"COMMENT_LIMIT", "comments per page", &server.CommentLimit},
+		{"FIREBASE_CREDENTIALS", "firebase service account key file", &server.FirebaseCredentials},
+		{"CLIENT_IP_HEADER", "header the proxy puts the client IP in, e.g. X-Forwarded-For", &server.ClientIPHeader},
+		{"LOG_LEVEL", "minimum level of logs, one of debug, info, warn and error", &server.LogLevel},
+		{"TRACE_EXPORTER", "exporter of traces, one of none, stdout and otlp", &server.TraceExporter},
+		{"TRACE_ENDPOINT", "host:port of the OTLP HTTP collector", &server.TraceEndpoint},
+		{"READ_TIMEOUT", "maximum duration of reading a request", &server.ReadTimeout},
+		{"WRITE_TIMEOUT", "maximum duration of writing a response", &server.WriteTimeout},
+		{"IDLE_TIMEOUT", "maximum idle duration of keep-alive connections", &server.IdleTimeout},
+		{"SHUTDOWN_TIMEOUT", "maximum duration of graceful shutdown", &server.ShutdownTimeout},
+		{"QUERY_TIMEOUT", "maximum duration of a database operation", &server.QueryTimeout},
+		{"BATCH_TIMEOUT", "maximum duration of a database operation on many documents", &server.BatchTimeout},
+		{"QUERY_MAX_TIME", "maximum time the database spends on an aggregation", &server.QueryMaxTime},
+		{"DRAIN_DELAY", "duration of reporting not ready before shutting down", &server.DrainDelay},
+		{"SMTP_ADDRESS", "host:port of the SMTP server, mails are logged when empty", &server.SMTPAddress},
+		{"SMTP_USERNAME", "username of the SMTP server", &server.SMTPUsername},
+		{"SMTP_PASSWORD", "password of the SMTP server", &server.SMTPPassword},
+		{"MAIL_FROM", "sender address of mails", &server.MailFrom},
+		{"APP_URL", "address of the app links in mails point to", &server.AppURL},
+		{"EMAIL_VERIFICATION_TTL", "validity of email verification links", &server.EmailVerificationTTL},
+		{"REQUIRE_VERIFIED_EMAIL", "only let users with a verified email post, true or false", &server.RequireVerifiedEmail},
+		{"PASSWORD_RESET_TTL", "validity of password reset links", &server.PasswordResetTTL},
+	}
+}
+
+func flagName(name string) string {
+	return strings.ReplaceAll(strings.ToLower(name), "_", "-")
+}
+
+// Load reads the configuration, later sources override earlier ones:
+// defaults, settings file, environment variables and flags
+//
+// Flags are registered on given flag set so commands can add their own flags,
+// args are parsed with it
+func Load(flags *flag.FlagSet, args []string) (Server, error) {
+	server := Defaults
+	settings := server.settings()
+
+	file := flags.String("config", "", "settings file, defaults to CONFIG_FILE or "+DefaultFile)
+	for _, setting := range settings {
+		flags.String(flagName(setting.name), "", setting.usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return server, err
+	}
+
+	values := map[string]string{}
+
+	path, explicit := *file, *file != ""
+	if !explicit {
+		path, explicit = os.LookupEnv("CONFIG_FILE")
+	}
+	if path == "" {
+		path = DefaultFile
+	}
+	read, err := godotenv.Read(path)
+	if err != nil && (explicit || !errors.Is(err, os.ErrNotExist)) {
+		return server, fmt.Errorf("Failed to read settings file %s: %v", path, err)
+	}
+	// Like godotenv.Load the file fills in variables the environment does
+	// not set, every one of them is exported since the AWS and Firebase SDKs
+	// read their credentials from the environment rather than from Server
+	for key, value := range read {
+		if _, ok := os.LookupEnv(key); !ok {
+			os.Setenv(key, value)
+		}
+	}
+
+	for _, setting := range settings {
+		if value, ok := os.LookupEnv(setting.name); ok {
+			values[setting.name] = value
+		}
+	}
+
+	flags.Visit(func(given *flag.Flag) {
+		for _, setting := range settings {
+			if given.Name == flagName(setting.name) {
+				values[setting.name] = given.Value.String()
+			}
+		}
+	})
+
+	problems := []string{}
+	for _, setting := range settings {
+		value, ok := values[setting.name]
+		if !ok || value == "" {
+			continue
+		}
+
+		switch target := setting.target.(type) {
+		case *string:
+			*target = value
+		case *int:
+			number, err := strconv.Atoi(value)
+			if err != nil {
+				problems = append(problems, setting.name+" must be a number, got "+strconv.Quote(value))
+				continue
+			}
+			*target = number
+		case *time.Duration:
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				problems = append(problems, setting.name+" must be a duration such as 30s, got "+strconv.Quote(value))
+				continue
+			}
+			*target = duration
+		case *bool:
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				problems = append(problems, setting.name+" must be true or false, got "+strconv.Quote(value))
+				continue
+			}
+			*target = enabled
+		}
+	}
+
+	problems = append(problems, server.validate()...)
+	if len(problems) > 0 {
+		return server, errors.New("Invalid configuration: " + strings.Join(problems, "; "))
+	}
+
+	return server, nil
+}
+
+func (server Server) validate() []string {
+	problems := []string{}
+
+	if server.DatabaseURI == "" {
+		problems = append(problems, "DB_CONN_STR is required")
+	}
+	if server.DatabaseName == "" {
+		problems = append(problems, "DATABASE_NAME is required")
+	}
+	if server.JWTSecret == "" {
+		problems = append(problems, "JWT_SECRET is required")
+	}
+	if server.Port < 1 || server.Port > 65535 {
+		problems = append(problems, "PORT must be between 1 and 65535")
+	}
+	if _, ok := logger.Levels[strings.ToLower(server.LogLevel)]; !ok {
+		problems = append(problems, "LOG_LEVEL must be one of debug, info, warn and error")
+	}
+	switch server.TraceExporter {
+	case "none", "stdout", "otlp":
+	default:
+		problems = append(problems, "TRACE_EXPORTER must be one of none, stdout and otlp")
+	}
+	if server.PostLimit < 1 {
+		problems = append(problems, "POST_LIMIT must be positive")
+	}
+	if server.CommentLimit < 1 {
+		problems = append(problems, "COMMENT_LIMIT must be positive")
+	}
+	for _, timeout := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"READ_TIMEOUT", server.ReadTimeout},
+		{"WRITE_TIMEOUT", server.WriteTimeout},
+		{"IDLE_TIMEOUT", server.IdleTimeout},
+		{"SHUTDOWN_TIMEOUT", server.ShutdownTimeout},
+		{"QUERY_TIMEOUT", server.QueryTimeout},
+		{"BATCH_TIMEOUT", server.BatchTimeout},
+		{"QUERY_MAX_TIME", server.QueryMaxTime},
+		{"EMAIL_VERIFICATION_TTL", server.EmailVerificationTTL},
+		{"PASSWORD_RESET_TTL", server.PasswordResetTTL},
+	} {
+		if timeout.value <= 0 {
+			problems = append(problems, timeout.name+" must be positive")
+		}
+	}
+
+	if server.MailFrom == "" {
+		problems = append(problems, "MAIL_FROM is required")
+	}
+	if server.AppURL == "" {
+		problems = append(problems, "APP_URL is required")
+	}
+
+	if server.DrainDelay < 0 {
+		problems = append(problems, "DRAIN_DELAY must not be negative")
+	}
+
+	return problems
+}
+
+// Fingerprint identifies the configuration without revealing it, secrets are
+// left out so they can not be guessed from it
+func (server Server) Fingerprint() string {
+	server.DatabaseURI = ""
+	server.JWTSecret = ""
+	server.SMTPPassword = ""
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%+v", server)))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// Addr returns the address the server listens on
+func (server Server) Addr() string {
+	return ":" + strconv.Itoa(server.Port)
+}
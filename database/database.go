@@ -0,0 +1,47 @@
+package database
+
+import (
+	"context"
+	"jt-api/config"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// timeouts bound database operations, they are set from the configuration at
+// startup and default to the configuration defaults
+var timeouts = struct {
+	query   time.Duration
+	batch   time.Duration
+	maxTime time.Duration
+}{
+	query:   config.Defaults.QueryTimeout,
+	batch:   config.Defaults.BatchTimeout,
+	maxTime: config.Defaults.QueryMaxTime,
+}
+
+// Configure sets the timeouts of database operations
+func Configure(conf config.Server) {
+	timeouts.query = conf.QueryTimeout
+	timeouts.batch = conf.BatchTimeout
+	timeouts.maxTime = conf.QueryMaxTime
+}
+
+// Query derives the context of an operation on a few documents from ctx,
+// which is the request context in handlers so operations stop when the client
+// goes away
+func Query(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, timeouts.query)
+}
+
+// Batch derives the context of an operation on many documents from ctx, such
+// as fanning out a post to timelines
+func Batch(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, timeouts.batch)
+}
+
+// Aggregate returns aggregation options limiting the time the server spends
+// on the aggregation
+func Aggregate() *options.AggregateOptions {
+	return options.Aggregate().SetMaxTime(timeouts.maxTime)
+}
@@ -0,0 +1,334 @@
+package edges
+
+import (
+	"context"
+	"errors"
+	"jt-api/database"
+	"jt-api/pagination"
+	"jt-api/views"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Kind describes a collection of edges, every edge links a From document to
+// a To document and exists at most once per pair
+type Kind struct {
+	Collection string
+	From       string
+	To         string
+}
+
+// Kinds of edges
+var (
+	Vote       = Kind{Collection: "votes", From: "user", To: "target"}
+	Follow     = Kind{Collection: "follows", From: "follower", To: "followee"}
+	Membership = Kind{Collection: "memberships", From: "user", To: "community"}
+)
+
+// Kinds lists every kind of edge
+var Kinds = []Kind{Vote, Follow, Membership}
+
+// ListLimit is the page size of edge listings
+const ListLimit = 20
+
+// NewestFirst is the sort order of edge listings
+var NewestFirst = []pagination.SortField{{Key: "date", Order: -1, Kind: pagination.Date}}
+
+// other returns the field on the other end of the edge
+func (kind Kind) other(field string) string {
+	if field == kind.From {
+		return kind.To
+	}
+	return kind.From
+}
+
+// Add links from to to, reports false if they were already linked
+func Add(ctx context.Context, db *mongo.Database, kind Kind, from primitive.ObjectID, to primitive.ObjectID) (bool, error) {
+	collection := db.Collection(kind.Collection)
+	ctx, cancel := database.Query(ctx)
+
+	defer cancel()
+
+	_, err := collection.InsertOne(ctx, bson.D{
+		primitive.E{Key: kind.From, Value: from},
+		primitive.E{Key: kind.To, Value: to},
+		primitive.E{Key: "date", Value: primitive.NewDateTimeFromTime(time.Now())},
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Remove unlinks from and to, reports false if they were not linked
+func Remove(ctx context.Context, db *mongo.Database, kind Kind, from primitive.ObjectID, to primitive.ObjectID) (bool, error) {
+	collection := db.Collection(kind.Collection)
+	ctx, cancel := database.Query(ctx)
+
+	defer cancel()
+
+	result, err := collection.DeleteOne(ctx, bson.D{
+		primitive.E{Key: kind.From, Value: from},
+		primitive.E{Key: kind.To, Value: to},
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return result.DeletedCount > 0, nil
+}
+
+// ErrNotFound is returned by Set when a counted document does not exist
+var ErrNotFound = errors.New("Not Found")
+
+// Counter is a count of edges kept on a document
+type Counter struct {
+	Collection string
+	ID         primitive.ObjectID
+	Field      string
+}
+
+// Set links from to to when linked is true and unlinks them otherwise, and
+// moves given counters along with the link. Reports whether the link changed,
+// setting a link to the state it is already in is not an error
+//
+// The unique index makes the link itself atomic, counters are only moved by
+// the request that changed it and are put back if a counted document is
+// missing
+func Set(ctx context.Context, db *mongo.Database, kind Kind, from primitive.ObjectID, to primitive.ObjectID, linked bool, counters ...Counter) (bool, error) {
+	link, unlink, delta := Add, Remove, 1
+	if !linked {
+		link, unlink, delta = Remove, Add, -1
+	}
+
+	changed, err := link(ctx, db, kind, from, to)
+	if err != nil || !changed {
+		return false, err
+	}
+
+	// The link changed, counters must follow it even if ctx is cancelled now
+	ctx = context.WithoutCancel(ctx)
+	for i, counter := range counters {
+		if err = increment(ctx, db, counter, delta); err != nil {
+			for _, done := range counters[:i] {
+				increment(ctx, db, done, -delta)
+			}
+			unlink(ctx, db, kind, from, to)
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func increment(ctx context.Context, db *mongo.Database, counter Counter, delta int) error {
+	collection := db.Collection(counter.Collection)
+	ctx, cancel := database.Query(ctx)
+
+	defer cancel()
+
+	result, err := collection.UpdateOne(
+		ctx,
+		bson.D{primitive.E{Key: "_id", Value: counter.ID}},
+		bson.D{primitive.E{Key: "$inc", Value: bson.D{primitive.E{Key: counter.Field, Value: delta}}}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// RemoveAll removes every edge of given kind that has id on given field, used
+// when the document on that end is deleted
+func RemoveAll(ctx context.Context, db *mongo.Database, kind Kind, field string, id primitive.ObjectID) error {
+	collection := db.Collection(kind.Collection)
+	ctx, cancel := database.Batch(ctx)
+
+	defer cancel()
+
+	_, err := collection.DeleteMany(ctx, bson.D{primitive.E{Key: field, Value: id}})
+	return err
+}
+
+// Targets returns IDs of every document linked from given document, e.g. the
+// users someone follows
+func Targets(ctx context.Context, db *mongo.Database, kind Kind, from primitive.ObjectID) ([]primitive.ObjectID, error) {
+	return ends(ctx, db, kind, kind.From, from)
+}
+
+// Sources returns IDs of every document linking to given document, e.g. the
+// followers of someone
+func Sources(ctx context.Context, db *mongo.Database, kind Kind, to primitive.ObjectID) ([]primitive.ObjectID, error) {
+	return ends(ctx, db, kind, kind.To, to)
+}
+
+func ends(ctx context.Context, db *mongo.Database, kind Kind, field string, id primitive.ObjectID) ([]primitive.ObjectID, error) {
+	collection := db.Collection(kind.Collection)
+	ctx, cancel := database.Batch(ctx)
+
+	defer cancel()
+
+	other := kind.other(field)
+	opts := options.Find().SetProjection(bson.D{
+		primitive.E{Key: "_id", Value: 0},
+		primitive.E{Key: other, Value: 1},
+	})
+	cursor, err := collection.Find(ctx, bson.D{primitive.E{Key: field, Value: id}}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []bson.M
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(results))
+	for _, result := range results {
+		if id, ok := result[other].(primitive.ObjectID); ok {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// Flag returns pipeline stages that set field as to whether the document is
+// linked from given document, e.g. whether the viewer upvoted a post
+func Flag(kind Kind, from primitive.ObjectID, as string) []bson.D {
+	lookup := bson.D{
+		primitive.E{
+			Key: "$lookup",
+			Value: bson.D{
+				primitive.E{Key: "from", Value: kind.Collection},
+				primitive.E{Key: "let", Value: bson.D{primitive.E{Key: "id", Value: "$_id"}}},
+				primitive.E{Key: "pipeline", Value: mongo.Pipeline{
+					bson.D{primitive.E{Key: "$match", Value: bson.D{
+						primitive.E{Key: kind.From, Value: from},
+						primitive.E{Key: "$expr", Value: bson.D{
+							primitive.E{Key: "$eq", Value: []interface{}{"$" + kind.To, "$$id"}},
+						}},
+					}}},
+					bson.D{primitive.E{Key: "$limit", Value: 1}},
+				}},
+				primitive.E{Key: "as", Value: as},
+			},
+		},
+	}
+
+	set := bson.D{
+		primitive.E{
+			Key: "$set",
+			Value: bson.D{primitive.E{Key: as, Value: bson.D{
+				primitive.E{Key: "$gt", Value: []interface{}{bson.D{primitive.E{Key: "$size", Value: "$" + as}}, 0}},
+			}}},
+		},
+	}
+
+	return []bson.D{lookup, set}
+}
+
+// UserItem is an item of user listings built from edges
+type UserItem struct {
+	ID   primitive.ObjectID `json:"_id" bson:"_id"`
+	Date primitive.DateTime `json:"date" bson:"date"`
+	User views.UserSummary  `json:"user" bson:"user"`
+}
+
+// Users returns a page of the users on the other end of the edges that have
+// id on given field, e.g. followers of a user when field is Follow.To
+//
+// Every item holds the edge ID and date which the page is sorted by, and the
+// user summary
+func Users(ctx context.Context, db *mongo.Database, kind Kind, field string, id primitive.ObjectID, page pagination.Page) ([]UserItem, error) {
+	collection := db.Collection(kind.Collection)
+	ctx, cancel := database.Query(ctx)
+
+	defer cancel()
+
+	match := bson.D{
+		primitive.E{Key: "$match", Value: bson.D{primitive.E{Key: field, Value: id}}},
+	}
+
+	project := bson.D{
+		primitive.E{
+			Key: "$project",
+			Value: bson.D{
+				primitive.E{Key: "_id", Value: "$_id"},
+				primitive.E{Key: "date", Value: "$date"},
+				primitive.E{Key: "user", Value: "$" + kind.other(field)},
+			},
+		},
+	}
+
+	exists := bson.D{
+		primitive.E{Key: "$match", Value: bson.D{primitive.E{Key: "user", Value: bson.D{
+			primitive.E{Key: "$exists", Value: true},
+		}}}},
+	}
+
+	opts := database.Aggregate()
+
+	pipeline := mongo.Pipeline{match}
+	pipeline = append(pipeline, page.Match()...)
+	pipeline = append(pipeline, page.Stages()...)
+	pipeline = append(pipeline, project)
+	pipeline = append(pipeline, views.LookupUser("user")...)
+	pipeline = append(pipeline, exists)
+
+	cursor, err := collection.Aggregate(ctx, pipeline, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []UserItem{}
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// CreateIndexes creates indexes of every edge collection
+func CreateIndexes(db *mongo.Database) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	for _, kind := range Kinds {
+		collection := db.Collection(kind.Collection)
+		_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+			{
+				Keys:    bson.D{primitive.E{Key: kind.From, Value: 1}, primitive.E{Key: kind.To, Value: 1}},
+				Options: options.Index().SetUnique(true),
+			},
+			{Keys: bson.D{
+				primitive.E{Key: kind.To, Value: 1},
+				primitive.E{Key: "date", Value: -1},
+				primitive.E{Key: "_id", Value: -1},
+			}},
+			{Keys: bson.D{
+				primitive.E{Key: kind.From, Value: 1},
+				primitive.E{Key: "date", Value: -1},
+				primitive.E{Key: "_id", Value: -1},
+			}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package edges
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// embedded is an ID array that edges used to be stored in
+type embedded struct {
+	collection string
+	array      string
+	kind       Kind
+	// field is the edge field that takes the array elements, the other one
+	// takes the ID of the document holding the array
+	field string
+}
+
+// Arrays that are migrated to edges, both sides of follows and memberships
+// are read in case they drifted apart
+var arrays = []embedded{
+	{collection: "posts", array: "upvotes", kind: Vote, field: Vote.From},
+	{collection: "comments", array: "upvotes", kind: Vote, field: Vote.From},
+	{collection: "users", array: "followers", kind: Follow, field: Follow.From},
+	{collection: "users", array: "follows", kind: Follow, field: Follow.To},
+	{collection: "communities", array: "members", kind: Membership, field: Membership.From},
+	{collection: "users", array: "communities", kind: Membership, field: Membership.To},
+}
+
+// Migrate copies embedded ID arrays into edge collections, edges that already
+// exist are kept so it is safe to run more than once
+func Migrate(db *mongo.Database) error {
+	if err := CreateIndexes(db); err != nil {
+		return err
+	}
+
+	for _, source := range arrays {
+		if err := migrate(db, source); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func migrate(db *mongo.Database, source embedded) error {
+	collection := db.Collection(source.collection)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+
+	defer cancel()
+
+	match := bson.D{
+		primitive.E{Key: "$match", Value: bson.D{
+			primitive.E{Key: source.array + ".0", Value: bson.D{primitive.E{Key: "$exists", Value: true}}},
+		}},
+	}
+
+	unwind := bson.D{primitive.E{Key: "$unwind", Value: "$" + source.array}}
+
+	project := bson.D{
+		primitive.E{
+			Key: "$project",
+			Value: bson.D{
+				primitive.E{Key: "_id", Value: 0},
+				primitive.E{Key: source.field, Value: "$" + source.array},
+				primitive.E{Key: source.kind.other(source.field), Value: "$_id"},
+				primitive.E{Key: "date", Value: "$$NOW"},
+			},
+		},
+	}
+
+	merge := bson.D{
+		primitive.E{
+			Key: "$merge",
+			Value: bson.D{
+				primitive.E{Key: "into", Value: source.kind.Collection},
+				primitive.E{Key: "on", Value: []string{source.kind.From, source.kind.To}},
+				primitive.E{Key: "whenMatched", Value: "keepExisting"},
+				primitive.E{Key: "whenNotMatched", Value: "insert"},
+			},
+		},
+	}
+
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{match, unwind, project, merge})
+	if err != nil {
+		return err
+	}
+
+	return cursor.Close(ctx)
+}
+
+// DropArrays removes the embedded ID arrays once they are migrated
+func DropArrays(db *mongo.Database) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+
+	defer cancel()
+
+	for _, source := range arrays {
+		collection := db.Collection(source.collection)
+		_, err := collection.UpdateMany(
+			ctx,
+			bson.D{primitive.E{Key: source.array, Value: bson.D{primitive.E{Key: "$exists", Value: true}}}},
+			bson.D{primitive.E{Key: "$unset", Value: bson.D{primitive.E{Key: source.array, Value: ""}}}},
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package logger
+
+import (
+	"context"
+	"jt-api/requestinfo"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+// Levels are the accepted values of LOG_LEVEL
+var Levels = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// Init makes the default logger write JSON lines in prod and readable text
+// elsewhere, records below level are dropped
+func Init(env string, level string) {
+	options := &slog.HandlerOptions{Level: Levels[strings.ToLower(level)]}
+
+	var handler slog.Handler = slog.NewTextHandler(os.Stdout, options)
+	if env == "prod" {
+		handler = slog.NewJSONHandler(os.Stdout, options)
+	}
+
+	slog.SetDefault(slog.New(handler))
+}
+
+// Fatal logs err and exits, for failures the process can not start without
+func Fatal(message string, err error) {
+	slog.Error(message, "error", err)
+	os.Exit(1)
+}
+
+// WithRequestID attaches given request ID to the request
+func WithRequestID(request *http.Request, id string) *http.Request {
+	return request.WithContext(context.WithValue(request.Context(), requestIDKey, id))
+}
+
+// RequestID returns the ID attached to the request
+func RequestID(request *http.Request) string {
+	id, _ := request.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// FromRequest returns the default logger annotated with the request ID, the
+// authenticated user and the route template of the request, work started by
+// the request such as background tasks should keep logging with it
+func FromRequest(request *http.Request) *slog.Logger {
+	attrs := []any{"requestId", RequestID(request)}
+	attrs = append(attrs, traceAttrs(request)...)
+
+	info := requestinfo.From(request)
+	attrs = append(attrs, "route", info.Route)
+	if info.UserID != "" {
+		attrs = append(attrs, "userId", info.UserID)
+	}
+
+	return slog.Default().With(attrs...)
+}
+
+// traceAttrs returns the trace ID of the request so logs can be matched with
+// its spans
+func traceAttrs(request *http.Request) []any {
+	spanContext := trace.SpanContextFromContext(request.Context())
+	if !spanContext.HasTraceID() {
+		return nil
+	}
+	return []any{"traceId", spanContext.TraceID().String()}
+}
+
+// Access logs every request once it is served
+func Access(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+
+		next.ServeHTTP(response, request)
+
+		info := requestinfo.From(request)
+		attrs := []any{
+			"requestId", RequestID(request),
+			"method", request.Method,
+			"path", request.URL.Path,
+			"route", info.Route,
+			"status", info.Status,
+			"durationMs", time.Since(start).Milliseconds(),
+		}
+		attrs = append(attrs, traceAttrs(request)...)
+
+		if info.UserID != "" {
+			attrs = append(attrs, "userId", info.UserID)
+		}
+
+		level := slog.LevelInfo
+		if info.Status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		slog.Log(request.Context(), level, "Request served", attrs...)
+	})
+}
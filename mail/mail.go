@@ -0,0 +1,147 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"jt-api/config"
+	"jt-api/tracing"
+	"log/slog"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Timeout bounds sending a mail in the background, a stalled server would
+// otherwise hold the task until shutdown
+const Timeout = 30 * time.Second
+
+// Message is a plain text mail to a single recipient
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender sends mails
+type Sender interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// New returns the sender of the configuration, mails are only logged when no
+// SMTP server is configured
+func New(conf config.Server) Sender {
+	if conf.SMTPAddress == "" {
+		return LogSender{}
+	}
+
+	sender := &SMTPSender{address: conf.SMTPAddress, from: conf.MailFrom}
+	if conf.SMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(conf.SMTPAddress)
+		sender.auth = smtp.PlainAuth("", conf.SMTPUsername, conf.SMTPPassword, host)
+	}
+	return sender
+}
+
+// LogSender logs mails instead of sending them, for development without an
+// SMTP server
+type LogSender struct{}
+
+// Send logs message, the body is only logged at debug level since it may
+// carry tokens
+func (LogSender) Send(ctx context.Context, message Message) error {
+	slog.InfoContext(ctx, "Mail not sent, SMTP_ADDRESS is not set", "to", message.To, "subject", message.Subject)
+	slog.DebugContext(ctx, "Mail body", "to", message.To, "body", message.Body)
+	return nil
+}
+
+// SMTPSender sends mails through an SMTP server, STARTTLS is used when the
+// server offers it
+type SMTPSender struct {
+	address string
+	from    string
+	auth    smtp.Auth
+}
+
+// Send sends message, giving up when ctx is done whether it is dialing or
+// talking to the server
+func (sender *SMTPSender) Send(ctx context.Context, message Message) (err error) {
+	ctx, span := tracing.Start(ctx, "mail.send", attribute.String("mail.subject", message.Subject))
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", sender.address)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+
+	defer stop()
+
+	host, _, _ := net.SplitHostPort(sender.address)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if sender.auth != nil {
+		if err = client.Auth(sender.auth); err != nil {
+			return err
+		}
+	}
+
+	if err = client.Mail(sender.from); err != nil {
+		return err
+	}
+	if err = client.Rcpt(message.To); err != nil {
+		return err
+	}
+
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(sender.format(message)); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// format returns message with its headers, line breaks of the body are
+// normalized to CRLF as SMTP requires
+func (sender *SMTPSender) format(message Message) []byte {
+	var builder strings.Builder
+
+	fmt.Fprintf(&builder, "From: %s\r\n", sender.from)
+	fmt.Fprintf(&builder, "To: %s\r\n", message.To)
+	fmt.Fprintf(&builder, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(&builder, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	builder.WriteString("MIME-Version: 1.0\r\n")
+	builder.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	builder.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	builder.WriteString("\r\n")
+	builder.WriteString(strings.ReplaceAll(strings.ReplaceAll(message.Body, "\r\n", "\n"), "\n", "\r\n"))
+	builder.WriteString("\r\n")
+
+	return []byte(builder.String())
+}
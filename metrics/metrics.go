@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"context"
+	"jt-api/requestinfo"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/event"
+)
+
+var (
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Duration of HTTP requests by route template.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by route template and status.",
+	}, []string{"route", "method", "status"})
+
+	mongoDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mongo_command_duration_seconds",
+		Help:    "Duration of MongoDB commands.",
+		Buckets: []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"command"})
+
+	mongoErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_command_errors_total",
+		Help: "Failed MongoDB commands.",
+	}, []string{"command"})
+
+	notificationsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "fcm_notifications_total",
+		Help: "Notifications sent through firebase cloud messaging by result.",
+	}, []string{"result"})
+
+	uploadBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "s3_upload_bytes",
+		Help:    "Size of images uploaded to S3.",
+		Buckets: prometheus.ExponentialBuckets(16*1024, 2, 8),
+	})
+
+	uploadDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "s3_upload_duration_seconds",
+		Help:    "Duration of S3 uploads by result.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"result"})
+)
+
+// Handler serves the metrics
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// knownMethods are labelled as they are, clients can send any method token so
+// the rest share one label
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+}
+
+// Middleware records duration and status of every request, routes are
+// labelled by their templates and unknown methods as other so clients can not
+// blow up cardinality. It wraps the whole router so unmatched routes and
+// panics are counted too
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+
+		next.ServeHTTP(response, request)
+
+		method := request.Method
+		if !knownMethods[method] {
+			method = "other"
+		}
+
+		info := requestinfo.From(request)
+		requestDuration.WithLabelValues(info.Route, method).Observe(time.Since(start).Seconds())
+		requestsTotal.WithLabelValues(info.Route, method, strconv.Itoa(info.Status)).Inc()
+	})
+}
+
+// CommandMonitor records duration and failures of MongoDB commands
+func CommandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Succeeded: func(ctx context.Context, succeeded *event.CommandSucceededEvent) {
+			mongoDuration.WithLabelValues(succeeded.CommandName).Observe(succeeded.Duration.Seconds())
+		},
+		Failed: func(ctx context.Context, failed *event.CommandFailedEvent) {
+			mongoDuration.WithLabelValues(failed.CommandName).Observe(failed.Duration.Seconds())
+			mongoErrors.WithLabelValues(failed.CommandName).Inc()
+		},
+	}
+}
+
+// Notification records the result of sending a notification
+func Notification(err error) {
+	notificationsTotal.WithLabelValues(result(err)).Inc()
+}
+
+// Upload records an upload of given size that started at start
+func Upload(size int, start time.Time, err error) {
+	uploadDuration.WithLabelValues(result(err)).Observe(time.Since(start).Seconds())
+	if err == nil {
+		uploadBytes.Observe(float64(size))
+	}
+}
+
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
@@ -1,33 +1,53 @@
 package middleware
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"jt-api/apierror"
+	"jt-api/config"
+	"jt-api/database"
+	"jt-api/logger"
+	"jt-api/requestinfo"
 	"jt-api/service/auth"
 	"net/http"
-	"os"
+	"runtime/debug"
 	"strings"
 
 	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// AuthMiddleware authentication middleware
-func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
+// maxRequestIDLength limits request IDs given by clients
+const maxRequestIDLength = 64
+
+// AuthMiddleware returns the authentication middleware checking tokens signed
+// with the configured secret, tokens issued before the user's password was
+// reset are refused
+func AuthMiddleware(db *mongo.Database, conf config.Server) func(next http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return authenticate(db, conf, next)
+	}
+}
+
+func authenticate(db *mongo.Database, conf config.Server, next http.HandlerFunc) http.HandlerFunc {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json")
 		header := request.Header.Get("Authorization")
 
 		if header == "" {
-			response.WriteHeader(http.StatusUnauthorized)
-			response.Write([]byte(`{ "message": "Unauthorized" }`))
+			apierror.Write(response, request, apierror.Unauthorized)
 			return
 		}
 
 		list := strings.Split(header, "Bearer ")
 
 		if len(list) < 2 {
-			response.WriteHeader(http.StatusUnauthorized)
-			response.Write([]byte(`{ "message": "Unauthorized" }`))
+			apierror.Write(response, request, apierror.Unauthorized)
 			return
 		}
 
@@ -36,11 +56,10 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 			}
 
-			return []byte(os.Getenv("JWT_SECRET")), nil
+			return []byte(conf.JWTSecret), nil
 		})
 		if err != nil {
-			response.WriteHeader(http.StatusUnauthorized)
-			response.Write([]byte(`{ "message": "Unauthorized" }`))
+			apierror.Write(response, request, apierror.Unauthorized)
 			return
 		}
 
@@ -48,12 +67,115 @@ func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 			var user auth.LoginUser
 			data, _ := json.Marshal(claims["user"])
 			json.Unmarshal(data, &user)
+
+			// Tokens issued before versions existed carry none, which
+			// matches users whose password was never reset
+			version, _ := claims["version"].(float64)
+			current, err := tokenVersion(request.Context(), db, user.ID)
+			if err != nil {
+				apierror.WriteError(response, request, err)
+				return
+			}
+			if int(version) != current {
+				apierror.Write(response, request, apierror.Unauthorized)
+				return
+			}
+
+			request = apierror.WithLanguage(request, user.Language)
 			request.SetBasicAuth(user.ID.Hex(), "")
+			requestinfo.From(request).UserID = user.ID.Hex()
 			next(response, request)
 		} else {
-			response.WriteHeader(http.StatusUnauthorized)
-			response.Write([]byte(`{ "message": "Unauthorized" }`))
+			apierror.Write(response, request, apierror.Unauthorized)
 			return
 		}
 	}
 }
+
+// tokenVersion returns the version tokens of the user must carry, a user that
+// no longer exists is unauthorized
+func tokenVersion(ctx context.Context, db *mongo.Database, id primitive.ObjectID) (int, error) {
+	ctx, cancel := database.Query(ctx)
+
+	defer cancel()
+
+	var user struct {
+		TokenVersion int `bson:"tokenVersion"`
+	}
+	opts := options.FindOne().SetProjection(bson.D{primitive.E{Key: "tokenVersion", Value: 1}})
+	err := db.Collection("users").FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}}, opts).Decode(&user)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, apierror.New(apierror.Unauthorized)
+	}
+	return user.TokenVersion, err
+}
+
+// VerifiedEmail returns the middleware stopping users without a verified
+// email when REQUIRE_VERIFIED_EMAIL is set, it goes inside the authentication
+// middleware. The database is checked since tokens outlive verification
+func VerifiedEmail(db *mongo.Database, conf config.Server) func(next http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		if !conf.RequireVerifiedEmail {
+			return next
+		}
+
+		return func(response http.ResponseWriter, request *http.Request) {
+			authID, _, _ := request.BasicAuth()
+			id, _ := primitive.ObjectIDFromHex(authID)
+
+			ctx, cancel := database.Query(request.Context())
+
+			defer cancel()
+
+			var user struct {
+				EmailVerified bool `bson:"emailVerified"`
+			}
+			opts := options.FindOne().SetProjection(bson.D{primitive.E{Key: "emailVerified", Value: 1}})
+			err := db.Collection("users").FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}}, opts).Decode(&user)
+			if err != nil {
+				apierror.WriteError(response, request, err)
+				return
+			}
+
+			if !user.EmailVerified {
+				apierror.Write(response, request, apierror.EmailNotVerified)
+				return
+			}
+
+			next(response, request)
+		}
+	}
+}
+
+// RequestID gives every request an ID, taken from X-Request-ID header when
+// the client sends one, and echoes it back in the response
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get("X-Request-ID")
+		if id == "" || len(id) > maxRequestIDLength {
+			id = primitive.NewObjectID().Hex()
+		}
+
+		response.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(response, logger.WithRequestID(request, id))
+	})
+}
+
+// Recover turns a panicking handler into an internal error response instead
+// of a dropped connection, the panic is logged with its stack trace
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+
+				logger.FromRequest(request).Error("Request panicked", "panic", recovered, "stack", string(debug.Stack()))
+				apierror.Write(response, request, apierror.Internal)
+			}
+		}()
+
+		next.ServeHTTP(response, request)
+	})
+}
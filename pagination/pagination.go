@@ -0,0 +1,258 @@
+package pagination
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrInvalidCursor is returned when a cursor can not be decoded
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// Kind is the type the values of a sort key have
+type Kind int
+
+// Kinds of sort keys, fields without a kind accept no cursor
+const (
+	Date Kind = iota + 1
+	Number
+)
+
+// SortField is a single key of a listing sort order, 1 for ascending and -1 for descending
+type SortField struct {
+	Key   string
+	Order int
+	Kind  Kind
+
+	// Field is the stored field the key is projected from, cursors are
+	// matched on it before the projection so an index can serve them.
+	// Defaults to Key
+	Field string
+}
+
+// stored returns the name of the field in stored documents
+func (field SortField) stored() string {
+	if field.Field != "" {
+		return field.Field
+	}
+	return field.Key
+}
+
+// accepts tells if value may be compared with the key, values come from
+// clients so anything else, above all documents that would be read as
+// operators, is rejected. Null is kept since documents may lack the key
+func (field SortField) accepts(value interface{}) bool {
+	switch value.(type) {
+	case nil:
+		return true
+	case primitive.DateTime:
+		return field.Kind == Date
+	case int32, int64, float64:
+		return field.Kind == Number
+	}
+	return false
+}
+
+// Cursor points right after the last item of a page
+type Cursor struct {
+	Values primitive.A        `bson:"v"`
+	ID     primitive.ObjectID `bson:"id"`
+}
+
+// Envelope is the common response model for cursor paginated listings
+type Envelope struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+// Page describes which slice of a listing is requested
+//
+// Requests routed with a {page} variable are served the old way with $skip and
+// a bare array response, every other request is cursor paginated
+type Page struct {
+	Number int
+	Cursor *Cursor
+	Limit  int
+	Sort   []SortField
+}
+
+// FromRequest reads page number or cursor from given request
+func FromRequest(request *http.Request, limit int, sort []SortField) (Page, error) {
+	page := Page{Limit: limit, Sort: sort}
+
+	if number, ok := mux.Vars(request)["page"]; ok {
+		value, err := strconv.Atoi(number)
+		if err != nil {
+			return page, err
+		}
+		if value < 1 {
+			value = 1
+		}
+		page.Number = value
+		return page, nil
+	}
+
+	if raw := request.URL.Query().Get("cursor"); raw != "" {
+		cursor, err := Decode(raw)
+		if err != nil || len(cursor.Values) != len(sort) {
+			return page, ErrInvalidCursor
+		}
+		for i, field := range sort {
+			if !field.accepts(cursor.Values[i]) {
+				return page, ErrInvalidCursor
+			}
+		}
+		page.Cursor = cursor
+	}
+
+	return page, nil
+}
+
+// Legacy tells if page is requested by page number
+func (page Page) Legacy() bool {
+	return page.Number > 0
+}
+
+// Match returns the pipeline stage that skips the documents up to the cursor,
+// none for the first page and legacy pages
+//
+// It filters stored fields, so it is meant to be placed before the projection
+// where an index can serve it
+func (page Page) Match() []bson.D {
+	if page.Legacy() || page.Cursor == nil {
+		return []bson.D{}
+	}
+
+	return []bson.D{{primitive.E{Key: "$match", Value: page.after()}}}
+}
+
+// Stages returns the pipeline stages that sort and slice the listing
+//
+// Sort keys must already be present on the documents, so the stages are meant
+// to be placed after the projection
+func (page Page) Stages() []bson.D {
+	order := bson.D{}
+	for _, field := range page.Sort {
+		order = append(order, primitive.E{Key: field.Key, Value: field.Order})
+	}
+	order = append(order, primitive.E{Key: "_id", Value: -1})
+
+	stages := []bson.D{}
+
+	if page.Legacy() {
+		stages = append(stages,
+			bson.D{primitive.E{Key: "$sort", Value: order}},
+			bson.D{primitive.E{Key: "$skip", Value: (page.Number - 1) * page.Limit}},
+			bson.D{primitive.E{Key: "$limit", Value: page.Limit}},
+		)
+		return stages
+	}
+
+	// One extra item tells whether there is a next page
+	stages = append(stages,
+		bson.D{primitive.E{Key: "$sort", Value: order}},
+		bson.D{primitive.E{Key: "$limit", Value: page.Limit + 1}},
+	)
+
+	return stages
+}
+
+// after builds a filter that matches stored documents sorted after the cursor
+func (page Page) after() bson.D {
+	keys := append(append([]SortField{}, page.Sort...), SortField{Key: "_id", Order: -1})
+	values := append(append(primitive.A{}, page.Cursor.Values...), page.Cursor.ID)
+
+	branches := []interface{}{}
+	for i, field := range keys {
+		branch := bson.D{}
+		for j := 0; j < i; j++ {
+			branch = append(branch, primitive.E{Key: keys[j].stored(), Value: values[j]})
+		}
+
+		operator := "$lt"
+		if field.Order > 0 {
+			operator = "$gt"
+		}
+		branch = append(branch, primitive.E{Key: field.stored(), Value: bson.D{
+			primitive.E{Key: operator, Value: values[i]},
+		}})
+
+		branches = append(branches, branch)
+	}
+
+	return bson.D{primitive.E{Key: "$or", Value: branches}}
+}
+
+// Write encodes given items as the response of the page, items is a slice of
+// documents or of structs with bson tags for the sort keys
+func (page Page) Write(response http.ResponseWriter, items interface{}) {
+	if page.Legacy() {
+		json.NewEncoder(response).Encode(items)
+		return
+	}
+
+	envelope := Envelope{Items: items}
+
+	value := reflect.ValueOf(items)
+	if page.Limit > 0 && value.Len() > page.Limit {
+		value = value.Slice(0, page.Limit)
+
+		envelope.Items = value.Interface()
+		envelope.NextCursor = page.cursorAfter(value.Index(page.Limit - 1).Interface())
+	}
+
+	json.NewEncoder(response).Encode(envelope)
+}
+
+// cursorAfter returns the encoded cursor pointing right after given item
+func (page Page) cursorAfter(item interface{}) string {
+	data, err := bson.Marshal(item)
+	if err != nil {
+		return ""
+	}
+
+	var last bson.M
+	if err = bson.Unmarshal(data, &last); err != nil {
+		return ""
+	}
+
+	cursor := Cursor{Values: primitive.A{}}
+	cursor.ID, _ = last["_id"].(primitive.ObjectID)
+	for _, field := range page.Sort {
+		cursor.Values = append(cursor.Values, last[field.Key])
+	}
+
+	return Encode(cursor)
+}
+
+// Encode converts cursor into an opaque string
+func Encode(cursor Cursor) string {
+	data, err := bson.Marshal(cursor)
+	if err != nil {
+		return ""
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Decode parses an opaque cursor string
+func Decode(raw string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var cursor Cursor
+	if err = bson.Unmarshal(data, &cursor); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &cursor, nil
+}
@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often full buckets are dropped from memory, a full
+// bucket is the same as no bucket
+const sweepInterval = time.Minute
+
+// maxBuckets bounds the memory of the store. A bucket still refilling is never
+// dropped to make room, since that would reset the limit of its client, so
+// new keys are refused while the store is full of them
+const maxBuckets = 100000
+
+// fullSweepInterval is how often a full store is swept for room, sweeping on
+// every refused request would make flooding the store costly for the server
+const fullSweepInterval = time.Second
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	policy  Policy
+}
+
+// refill adds the tokens refilled since the last update
+func (bucket *bucket) refill(now time.Time) {
+	elapsed := now.Sub(bucket.updated).Seconds()
+	bucket.tokens = math.Min(float64(bucket.policy.Limit), bucket.tokens+elapsed*bucket.policy.rate())
+	bucket.updated = now
+}
+
+// MemoryStore keeps token buckets in memory of a single instance
+type MemoryStore struct {
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// NewMemoryStore returns an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]*bucket{}, swept: time.Now()}
+}
+
+// Take takes a token from the bucket of key, a key without a bucket is
+// refused while the store is full
+func (store *MemoryStore) Take(ctx context.Context, key string, policy Policy) (Result, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(store.swept) > sweepInterval {
+		store.sweep(now)
+	}
+
+	current, ok := store.buckets[key]
+	if !ok {
+		if len(store.buckets) >= maxBuckets && now.Sub(store.swept) > fullSweepInterval {
+			store.sweep(now)
+		}
+		if len(store.buckets) >= maxBuckets {
+			return Result{Allowed: false, RetryAfter: fullSweepInterval, Reset: fullSweepInterval}, nil
+		}
+
+		current = &bucket{tokens: float64(policy.Limit), updated: now, policy: policy}
+		store.buckets[key] = current
+	}
+	current.refill(now)
+
+	result := Result{Allowed: current.tokens >= 1}
+	if result.Allowed {
+		current.tokens--
+	} else {
+		result.RetryAfter = policy.refillTime(1 - current.tokens)
+	}
+	result.Remaining = int(current.tokens)
+	result.Reset = policy.refillTime(float64(policy.Limit) - current.tokens)
+
+	return result, nil
+}
+
+// sweep drops full buckets, the only ones that can go without changing a limit
+func (store *MemoryStore) sweep(now time.Time) {
+	for key, current := range store.buckets {
+		current.refill(now)
+		if current.tokens >= float64(current.policy.Limit) {
+			delete(store.buckets, key)
+		}
+	}
+	store.swept = now
+}
@@ -0,0 +1,137 @@
+package ratelimit
+
+import (
+	"context"
+	"jt-api/apierror"
+	"jt-api/config"
+	"jt-api/logger"
+	"jt-api/requestinfo"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy allows Limit requests per Period to every client, requests are
+// refilled steadily so a client that used its limit gets a request back every
+// Period/Limit
+type Policy struct {
+	Name   string
+	Limit  int
+	Period time.Duration
+}
+
+// rate returns requests refilled per second
+func (policy Policy) rate() float64 {
+	return float64(policy.Limit) / policy.Period.Seconds()
+}
+
+// refillTime returns how long refilling given requests takes
+func (policy Policy) refillTime(requests float64) time.Duration {
+	return time.Duration(requests / policy.rate() * float64(time.Second))
+}
+
+// Policies of the routes, every route that is limited uses one of these
+var (
+	Login         = Policy{Name: "login", Limit: 10, Period: time.Minute}
+	Signup        = Policy{Name: "signup", Limit: 5, Period: time.Hour}
+	Exists        = Policy{Name: "exists", Limit: 30, Period: time.Minute}
+	Search        = Policy{Name: "search", Limit: 30, Period: time.Minute}
+	Write         = Policy{Name: "write", Limit: 60, Period: time.Minute}
+	Verification  = Policy{Name: "verification", Limit: 5, Period: time.Hour}
+	PasswordReset = Policy{Name: "password_reset", Limit: 5, Period: time.Hour}
+)
+
+// Result is the state of a client's bucket after taking a request from it
+type Result struct {
+	Allowed   bool
+	Remaining int
+
+	// Reset is when the bucket is full again, RetryAfter is when the next
+	// request is allowed if this one is not
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// Store keeps the buckets of clients, the in-memory store serves a single
+// instance and a shared store is needed once there are more
+type Store interface {
+	Take(ctx context.Context, key string, policy Policy) (Result, error)
+}
+
+// Limiter limits requests of clients by the policies of their routes
+type Limiter struct {
+	store          Store
+	clientIPHeader string
+}
+
+// New returns a limiter keeping buckets in store
+func New(store Store, conf config.Server) *Limiter {
+	return &Limiter{store: store, clientIPHeader: conf.ClientIPHeader}
+}
+
+// Limit returns a middleware limiting requests by policy, authenticated
+// requests are counted per user and the rest per IP, so it goes inside the
+// authentication middleware
+//
+// Requests are let through when the store fails, limiting is not worth an
+// outage
+func (limiter *Limiter) Limit(policy Policy) func(next http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(response http.ResponseWriter, request *http.Request) {
+			result, err := limiter.store.Take(request.Context(), limiter.key(request, policy), policy)
+			if err != nil {
+				logger.FromRequest(request).Error("Failed to take from rate limit bucket", "policy", policy.Name, "error", err)
+				next(response, request)
+				return
+			}
+
+			header := response.Header()
+			header.Set("X-RateLimit-Limit", strconv.Itoa(policy.Limit))
+			header.Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			header.Set("X-RateLimit-Reset", seconds(result.Reset))
+
+			if !result.Allowed {
+				header.Set("Retry-After", seconds(result.RetryAfter))
+				apierror.Write(response, request, apierror.RateLimited)
+				return
+			}
+
+			next(response, request)
+		}
+	}
+}
+
+// key returns the bucket of the client, only users verified by the auth
+// middleware get their own bucket since clients can send any Authorization
+// header on routes without authentication
+func (limiter *Limiter) key(request *http.Request, policy Policy) string {
+	if userID := requestinfo.From(request).UserID; userID != "" {
+		return policy.Name + ":user:" + userID
+	}
+	return policy.Name + ":ip:" + ClientIP(request, limiter.clientIPHeader)
+}
+
+// ClientIP returns the IP of the client, taken from given header when the
+// server is behind a proxy. The last address of the header is used since that
+// is the one added by the proxy, earlier ones are sent by clients
+func ClientIP(request *http.Request, header string) string {
+	if header != "" {
+		values := strings.Split(request.Header.Get(header), ",")
+		if ip := strings.TrimSpace(values[len(values)-1]); ip != "" {
+			return ip
+		}
+	}
+
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		return request.RemoteAddr
+	}
+	return host
+}
+
+func seconds(duration time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(duration.Seconds())))
+}
@@ -0,0 +1,65 @@
+package requestinfo
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type contextKey int
+
+const infoKey contextKey = iota
+
+// Info is what the middleware around the router learns about a request, it
+// is shared by pointer so the outer middleware sees what the inner sets
+type Info struct {
+	// Route is the template of the matched route, unknown when no route
+	// matches so it is safe as a metric label
+	Route string
+
+	// Status is the status of the response, known once the request is served
+	Status int
+
+	// UserID is the user the auth middleware verified the token of, empty on
+	// routes without authentication. Unlike the Authorization header it can
+	// not be set by clients
+	UserID string
+}
+
+// Middleware resolves the route of every request once and records the status
+// of its response, it goes outside of the middleware reading them
+func Middleware(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		info := &Info{Route: "unknown", Status: http.StatusOK}
+
+		var match mux.RouteMatch
+		if router.Match(request, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				info.Route = template
+			}
+		}
+
+		recorder := &recorder{ResponseWriter: response, info: info}
+		next.ServeHTTP(recorder, request.WithContext(context.WithValue(request.Context(), infoKey, info)))
+	})
+}
+
+// From returns the info of the request, an empty one when the request did not
+// go through Middleware
+func From(request *http.Request) *Info {
+	if info, ok := request.Context().Value(infoKey).(*Info); ok {
+		return info
+	}
+	return &Info{Route: "unknown", Status: http.StatusOK}
+}
+
+type recorder struct {
+	http.ResponseWriter
+	info *Info
+}
+
+func (recorder *recorder) WriteHeader(status int) {
+	recorder.info.Status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
@@ -2,112 +2,259 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"jt-api/background"
+	"jt-api/config"
+	"jt-api/database"
+	"jt-api/edges"
+	"jt-api/logger"
+	"jt-api/mail"
+	"jt-api/metrics"
 	"jt-api/middleware"
+	"jt-api/ratelimit"
+	"jt-api/requestinfo"
 	"jt-api/service/auth"
 	"jt-api/service/comments"
 	"jt-api/service/communities"
+	"jt-api/service/counters"
 	"jt-api/service/embed"
+	"jt-api/service/health"
 	"jt-api/service/notification"
 	"jt-api/service/posts"
 	"jt-api/service/search"
+	"jt-api/service/tags"
+	"jt-api/service/timeline"
 	"jt-api/service/upload"
 	"jt-api/service/users"
-	"log"
+	"jt-api/service/verification"
+	"jt-api/tracing"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 func main() {
-	godotenv.Load()
-	if os.Getenv("ENV") == "prod" {
+	conf, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		logger.Fatal("Failed to load configuration", err)
+	}
+	logger.Init(conf.Env, conf.LogLevel)
+	database.Configure(conf)
+	shutdownTracing, err := tracing.Init(conf)
+	if err != nil {
+		logger.Fatal("Failed to initialize tracing", err)
+	}
+	if conf.Env == "prod" {
 		fun()
 	}
 
-	fmt.Println("Starting Justhink Backend...")
-	fmt.Println("Environment variables are set")
+	slog.Info("Starting Justhink Backend...", "env", conf.Env, "config", conf.Fingerprint())
 
-	notification.InitFirebase()
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	notification.InitFirebase(conf)
+	connectCtx, cancelConnect := context.WithTimeout(context.Background(), 10*time.Second)
+	client, err := mongo.Connect(connectCtx, options.Client().ApplyURI(conf.DatabaseURI).SetMonitor(tracing.CommandMonitor(metrics.CommandMonitor())))
+	cancelConnect()
+	if err != nil {
+		logger.Fatal("Failed to connect to database", err)
+	}
+	slog.Info("Connected to database")
 
-	defer cancel()
+	db := client.Database(conf.DatabaseName)
 
-	client, err := mongo.Connect(ctx, options.Client().ApplyURI(os.Getenv("DB_CONN_STR")))
-	if err != nil {
-		fmt.Println("Failed to connect to database")
-		log.Fatal(err)
+	if err = edges.CreateIndexes(db); err != nil {
+		logger.Fatal("Failed to create edge indexes", err)
+	}
+	if err = tags.CreateIndexes(db); err != nil {
+		logger.Fatal("Failed to create tag indexes", err)
+	}
+	if err = timeline.CreateIndexes(db); err != nil {
+		logger.Fatal("Failed to create timeline indexes", err)
+	}
+	if err = posts.CreateIndexes(db); err != nil {
+		logger.Fatal("Failed to create post indexes", err)
+	}
+	if err = counters.CreateIndexes(db); err != nil {
+		logger.Fatal("Failed to create counter indexes", err)
+	}
+	if err = users.CreateIndexes(db); err != nil {
+		logger.Fatal("Failed to create user indexes", err)
+	}
+	if err = auth.CreateIndexes(db); err != nil {
+		logger.Fatal("Failed to create auth indexes", err)
 	}
-	fmt.Println("Connected to database")
+
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	background.Go(func() {
+		posts.RunRankingJob(jobsCtx, db, 5*time.Minute)
+	})
 
 	router := mux.NewRouter()
+	authenticated := middleware.AuthMiddleware(db, conf)
+	limiter := ratelimit.New(ratelimit.NewMemoryStore(), conf)
+	writes := limiter.Limit(ratelimit.Write)
+	verified := middleware.VerifiedEmail(db, conf)
+	sender := mail.New(conf)
 
 	// Users route
 	usersRoute := router.PathPrefix("/users").Subrouter()
-	usersRoute.HandleFunc("/find/{id}", middleware.AuthMiddleware(users.GetUser(client))).Methods("GET")
-	usersRoute.HandleFunc("/exists/{type}/{query}", users.UserExists(client)).Methods("GET")
-	usersRoute.HandleFunc("/signup", users.CreateUser(client)).Methods("POST")
-	usersRoute.HandleFunc("/edit", middleware.AuthMiddleware(users.EditUser(client))).Methods("POST")
-	usersRoute.HandleFunc("/action/{type}", middleware.AuthMiddleware(users.UserAction(client))).Methods("POST")
-	usersRoute.HandleFunc("/updateFCMToken", middleware.AuthMiddleware(users.UpdateFCMToken(client))).Methods("POST")
+	usersRoute.HandleFunc("/find/{id}", authenticated(users.GetUser(db))).Methods("GET")
+	usersRoute.HandleFunc("/exists/{type}/{query}", limiter.Limit(ratelimit.Exists)(users.UserExists(db))).Methods("GET")
+	usersRoute.HandleFunc("/signup", limiter.Limit(ratelimit.Signup)(users.CreateUser(db, conf, sender))).Methods("POST")
+	usersRoute.HandleFunc("/edit", authenticated(writes(users.EditUser(db, conf, sender)))).Methods("POST")
+	usersRoute.HandleFunc("/action/{type}", authenticated(writes(users.UserAction(db)))).Methods("POST")
+	usersRoute.HandleFunc("/updateFCMToken", authenticated(writes(users.UpdateFCMToken(db)))).Methods("POST")
+	usersRoute.HandleFunc("/{id}/followers", authenticated(users.Followers(db))).Methods("GET")
+	usersRoute.HandleFunc("/{id}/following", authenticated(users.Following(db))).Methods("GET")
+	usersRoute.HandleFunc("/{id}/follow", authenticated(writes(users.Follow(db)))).Methods("PUT", "DELETE")
 
 	// Posts route
 	postsRoute := router.PathPrefix("/posts").Subrouter()
-	postsRoute.HandleFunc("/delete/{id}", middleware.AuthMiddleware(posts.DeletePost(client))).Methods("GET")
-	postsRoute.HandleFunc("/find/{id}", middleware.AuthMiddleware(posts.GetPost(client))).Methods("GET")
-	postsRoute.HandleFunc("/personal/{page}", middleware.AuthMiddleware(posts.GetPersonal(client))).Methods("GET")
-	postsRoute.HandleFunc("/new/{page}", middleware.AuthMiddleware(posts.GetNew(client))).Methods("GET")
-	postsRoute.HandleFunc("/liked/{page}", middleware.AuthMiddleware(posts.GetLiked(client))).Methods("GET")
-	postsRoute.HandleFunc("/community/posts/{id}/{page}", middleware.AuthMiddleware(posts.CommunityPosts(client))).Methods("GET")
-	postsRoute.HandleFunc("/community/feed/{id}/{page}", middleware.AuthMiddleware(posts.CommunityFeed(client))).Methods("GET")
-	postsRoute.HandleFunc("/create", middleware.AuthMiddleware(posts.CreatePost(client))).Methods("POST")
-	postsRoute.HandleFunc("/action/{type}", middleware.AuthMiddleware(posts.PostAction(client))).Methods("POST")
+	postsRoute.HandleFunc("/delete/{id}", authenticated(writes(posts.DeletePost(db)))).Methods("GET")
+	postsRoute.HandleFunc("/find/{id}", authenticated(posts.GetPost(db))).Methods("GET")
+	postsRoute.HandleFunc("/personal", authenticated(posts.GetPersonal(db, conf))).Methods("GET")
+	postsRoute.HandleFunc("/personal/{page}", authenticated(posts.GetPersonal(db, conf))).Methods("GET")
+	postsRoute.HandleFunc("/new", authenticated(posts.GetNew(db, conf))).Methods("GET")
+	postsRoute.HandleFunc("/new/{page}", authenticated(posts.GetNew(db, conf))).Methods("GET")
+	postsRoute.HandleFunc("/liked", authenticated(posts.GetLiked(db, conf))).Methods("GET")
+	postsRoute.HandleFunc("/liked/{page}", authenticated(posts.GetLiked(db, conf))).Methods("GET")
+	postsRoute.HandleFunc("/community/posts/{id}", authenticated(posts.CommunityPosts(db, conf))).Methods("GET")
+	postsRoute.HandleFunc("/community/posts/{id}/{page}", authenticated(posts.CommunityPosts(db, conf))).Methods("GET")
+	postsRoute.HandleFunc("/community/feed/{id}", authenticated(posts.CommunityFeed(db, conf))).Methods("GET")
+	postsRoute.HandleFunc("/community/feed/{id}/{page}", authenticated(posts.CommunityFeed(db, conf))).Methods("GET")
+	postsRoute.HandleFunc("/create", authenticated(writes(verified(posts.CreatePost(db))))).Methods("POST")
+	postsRoute.HandleFunc("/action/{type}", authenticated(writes(posts.PostAction(db)))).Methods("POST")
+	postsRoute.HandleFunc("/{id}/upvoters", authenticated(posts.Upvoters(db))).Methods("GET")
+	postsRoute.HandleFunc("/{id}/upvote", authenticated(writes(posts.Upvote(db)))).Methods("PUT", "DELETE")
 
 	// Comments route
 	commentsRoute := router.PathPrefix("/comments").Subrouter()
-	commentsRoute.HandleFunc("/of/{id}/{page}", middleware.AuthMiddleware(comments.GetComments(client))).Methods("GET")
-	commentsRoute.HandleFunc("/delete/{id}", middleware.AuthMiddleware(comments.DeleteComment(client))).Methods("GET")
-	commentsRoute.HandleFunc("/create", middleware.AuthMiddleware(comments.CreateComment(client))).Methods("POST")
-	commentsRoute.HandleFunc("/action/{type}", middleware.AuthMiddleware(comments.CommentAction(client))).Methods("POST")
+	commentsRoute.HandleFunc("/of/{id}", authenticated(comments.GetComments(db, conf))).Methods("GET")
+	commentsRoute.HandleFunc("/of/{id}/{page}", authenticated(comments.GetComments(db, conf))).Methods("GET")
+	commentsRoute.HandleFunc("/delete/{id}", authenticated(writes(comments.DeleteComment(db)))).Methods("GET")
+	commentsRoute.HandleFunc("/create", authenticated(writes(verified(comments.CreateComment(db))))).Methods("POST")
+	commentsRoute.HandleFunc("/action/{type}", authenticated(writes(comments.CommentAction(db)))).Methods("POST")
+	commentsRoute.HandleFunc("/{id}/upvote", authenticated(writes(comments.Upvote(db)))).Methods("PUT", "DELETE")
 
 	// Communities route
 	communitiesRoute := router.PathPrefix("/communities").Subrouter()
-	communitiesRoute.HandleFunc("/find/{id}", middleware.AuthMiddleware(communities.GetCommunity(client))).Methods("GET")
-	communitiesRoute.HandleFunc("/of/{id}", middleware.AuthMiddleware(communities.GetUsersCommunities(client))).Methods("GET")
-	communitiesRoute.HandleFunc("/create", middleware.AuthMiddleware(communities.CreateCommunity(client))).Methods("POST")
-	communitiesRoute.HandleFunc("/action/{type}", middleware.AuthMiddleware(communities.CommunityAction(client))).Methods("POST")
+	communitiesRoute.HandleFunc("/find/{id}", authenticated(communities.GetCommunity(db))).Methods("GET")
+	communitiesRoute.HandleFunc("/of/{id}", authenticated(communities.GetUsersCommunities(db))).Methods("GET")
+	communitiesRoute.HandleFunc("/create", authenticated(writes(communities.CreateCommunity(db)))).Methods("POST")
+	communitiesRoute.HandleFunc("/action/{type}", authenticated(writes(communities.CommunityAction(db)))).Methods("POST")
+	communitiesRoute.HandleFunc("/{id}/members", authenticated(communities.Members(db))).Methods("GET")
+	communitiesRoute.HandleFunc("/{id}/membership", authenticated(writes(communities.Membership(db)))).Methods("PUT", "DELETE")
+
+	// Tags route
+	tagsRoute := router.PathPrefix("/tags").Subrouter()
+	tagsRoute.HandleFunc("/trending", tags.Trending(db)).Methods("GET")
+	tagsRoute.HandleFunc("/followed", authenticated(tags.GetFollowed(db))).Methods("GET")
+	tagsRoute.HandleFunc("/action/{type}", authenticated(writes(tags.TagAction(db)))).Methods("POST")
+	tagsRoute.HandleFunc("/{tag}", authenticated(posts.TagPosts(db, conf))).Methods("GET")
+	tagsRoute.HandleFunc("/{tag}/{page}", authenticated(posts.TagPosts(db, conf))).Methods("GET")
 
 	// Auth route
 	authRoute := router.PathPrefix("/auth").Subrouter()
-	authRoute.HandleFunc("/login", auth.Login(client)).Methods("POST")
+	authRoute.HandleFunc("/login", limiter.Limit(ratelimit.Login)(auth.Login(db, conf))).Methods("POST")
+	authRoute.HandleFunc("/forgot-password", limiter.Limit(ratelimit.PasswordReset)(auth.ForgotPassword(db, conf, sender))).Methods("POST")
+	authRoute.HandleFunc("/reset-password", limiter.Limit(ratelimit.PasswordReset)(auth.ResetPassword(db))).Methods("POST")
+	authRoute.HandleFunc("/verify-email", limiter.Limit(ratelimit.Verification)(verification.VerifyEmail(db, conf))).Methods("POST")
+	authRoute.HandleFunc("/verify-email/resend", authenticated(limiter.Limit(ratelimit.Verification)(verification.Resend(db, conf, sender)))).Methods("POST")
 
 	// Upload route
 	uploadRoute := router.PathPrefix("/upload").Subrouter()
-	uploadRoute.HandleFunc("/", middleware.AuthMiddleware(upload.Image(client, 512))).Methods("POST")
+	uploadRoute.HandleFunc("/", authenticated(writes(upload.Image(db, conf, 512)))).Methods("POST")
 
 	// Search route
 	searchRoute := router.PathPrefix("/search").Subrouter()
-	searchRoute.HandleFunc("/content/{query}", search.Content(client)).Methods("GET")
+	searchRoute.HandleFunc("/content/{query}", limiter.Limit(ratelimit.Search)(search.Content(db))).Methods("GET")
 
 	// Notification route
 	notificationRoute := router.PathPrefix("/notification").Subrouter()
-	notificationRoute.HandleFunc("/", middleware.AuthMiddleware(notification.GetNotifications(client))).Methods("GET")
-	notificationRoute.HandleFunc("/send/u/{username}", notification.SendToUsername(client)).Methods("POST")
-	notificationRoute.HandleFunc("/send/id/{id}", notification.SendToID(client)).Methods("POST")
+	notificationRoute.HandleFunc("/", authenticated(notification.GetNotifications(db))).Methods("GET")
+	notificationRoute.HandleFunc("/send/u/{username}", writes(notification.SendToUsername(db))).Methods("POST")
+	notificationRoute.HandleFunc("/send/id/{id}", writes(notification.SendToID(db))).Methods("POST")
+
+	// Health routes
+	router.HandleFunc("/healthz", health.Live()).Methods("GET")
+	router.HandleFunc("/readyz", health.Ready(db, conf)).Methods("GET")
+	router.HandleFunc("/version", health.Version(conf)).Methods("GET")
+	router.Handle("/metrics", metrics.Handler()).Methods("GET")
 
 	// Embed route
 	embedRoute := router.PathPrefix("/embed").Subrouter()
-	embedRoute.HandleFunc("/p/{id}/{theme}/{width}/{height}", embed.Post(client)).Methods("GET")
+	embedRoute.HandleFunc("/p/{id}/{theme}/{width}/{height}", embed.Post(db)).Methods("GET")
+
+	loggedRouter := middleware.RequestID(requestinfo.Middleware(router, metrics.Middleware(tracing.Middleware(logger.Access(middleware.Recover(router))))))
+	server := &http.Server{
+		Addr:         conf.Addr(),
+		Handler:      loggedRouter,
+		ReadTimeout:  conf.ReadTimeout,
+		WriteTimeout: conf.WriteTimeout,
+		IdleTimeout:  conf.IdleTimeout,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Fatal("Failed to start server", err)
+		}
+	}()
+	slog.Info("Server is up", "port", conf.Port)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	shutdown(conf, server, client, stopJobs, shutdownTracing)
+}
+
+// shutdown reports not ready for the drain delay, stops accepting requests,
+// waits for in-flight requests and background tasks to finish, then
+// disconnects from the database and flushes pending spans
+//
+// Notifications are sent within requests and background tasks, so there is
+// nothing left to flush once they are drained
+func shutdown(
+	conf config.Server,
+	server *http.Server,
+	client *mongo.Client,
+	stopJobs context.CancelFunc,
+	shutdownTracing func(ctx context.Context) error,
+) {
+	slog.Info("Shutting down...")
+
+	health.Drain()
+	time.Sleep(conf.DrainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Failed to drain requests", "error", err)
+	}
+
+	stopJobs()
+	if err := background.Wait(ctx); err != nil {
+		slog.Error("Failed to wait for background tasks", "error", err)
+	}
+
+	if err := client.Disconnect(ctx); err != nil {
+		slog.Error("Failed to disconnect from database", "error", err)
+	}
+
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Failed to flush traces", "error", err)
+	}
 
-	fmt.Println("Server is up and listening on port " + os.Getenv("PORT"))
-	loggedRouter := handlers.LoggingHandler(os.Stdout, router)
-	http.ListenAndServe(":"+os.Getenv("PORT"), loggedRouter)
+	slog.Info("Server is stopped")
 }
 
 func fun() {
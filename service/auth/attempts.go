@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"context"
+	"jt-api/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Results of login attempts, locked attempts are refused before the password
+// is checked and do not count as failures
+const (
+	attemptSucceeded = "succeeded"
+	attemptFailed    = "failed"
+	attemptLocked    = "locked"
+)
+
+const (
+	// attemptWindow is how far back failures are counted
+	attemptWindow = 15 * time.Minute
+
+	// lockDuration is how long logins are refused once a limit is reached
+	lockDuration = 15 * time.Minute
+
+	// Delays start at baseDelay and double with every failure up to maxDelay
+	baseDelay = time.Second
+	maxDelay  = time.Minute
+
+	// attemptRetention is how long attempts are kept for auditing
+	attemptRetention = 90 * 24 * time.Hour
+)
+
+// Attempt is the audit record of a login attempt
+type Attempt struct {
+	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Username  string             `json:"username" bson:"username"`
+	User      primitive.ObjectID `json:"user,omitempty" bson:"user,omitempty"`
+	IP        string             `json:"ip" bson:"ip"`
+	UserAgent string             `json:"userAgent,omitempty" bson:"userAgent,omitempty"`
+	Result    string             `json:"result" bson:"result"`
+	Date      primitive.DateTime `json:"date" bson:"date"`
+}
+
+// throttle limits failed logins sharing the value of field, an account can be
+// guessed from many addresses and an address can guess many accounts so both
+// are throttled
+type throttle struct {
+	field      string
+	delayAfter int
+	lockAfter  int
+
+	// A successful login of the account clears its failures, a success from
+	// an address does not since an attacker may own one of the accounts
+	resetOnSuccess bool
+}
+
+var (
+	accountThrottle = throttle{field: "username", delayAfter: 3, lockAfter: 10, resetOnSuccess: true}
+	ipThrottle      = throttle{field: "ip", delayAfter: 10, lockAfter: 50}
+)
+
+// wait returns how long value has to wait before its next attempt and its
+// recent failures
+func (throttle throttle) wait(ctx context.Context, collection *mongo.Collection, value string, now time.Time) (time.Duration, int, error) {
+	since := now.Add(-attemptWindow)
+
+	if throttle.resetOnSuccess {
+		var last Attempt
+		err := collection.FindOne(ctx, bson.D{
+			primitive.E{Key: throttle.field, Value: value},
+			primitive.E{Key: "result", Value: attemptSucceeded},
+			primitive.E{Key: "date", Value: bson.D{primitive.E{Key: "$gt", Value: primitive.NewDateTimeFromTime(since)}}},
+		}, options.FindOne().SetSort(bson.D{primitive.E{Key: "date", Value: -1}})).Decode(&last)
+
+		if err == nil {
+			since = last.Date.Time()
+		} else if err != mongo.ErrNoDocuments {
+			return 0, 0, err
+		}
+	}
+
+	// Failures beyond the lock limit do not change the wait, so only that
+	// many are read
+	cursor, err := collection.Find(ctx, bson.D{
+		primitive.E{Key: throttle.field, Value: value},
+		primitive.E{Key: "result", Value: attemptFailed},
+		primitive.E{Key: "date", Value: bson.D{primitive.E{Key: "$gt", Value: primitive.NewDateTimeFromTime(since)}}},
+	}, options.Find().
+		SetSort(bson.D{primitive.E{Key: "date", Value: -1}}).
+		SetLimit(int64(throttle.lockAfter)).
+		SetProjection(bson.D{primitive.E{Key: "date", Value: 1}}))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var failures []Attempt
+	if err = cursor.All(ctx, &failures); err != nil {
+		return 0, 0, err
+	}
+
+	if len(failures) < throttle.delayAfter {
+		return 0, len(failures), nil
+	}
+
+	delay := lockDuration
+	if len(failures) < throttle.lockAfter {
+		delay = baseDelay << (len(failures) - throttle.delayAfter)
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+
+	return failures[0].Date.Time().Add(delay).Sub(now), len(failures), nil
+}
+
+// recordAttempt saves attempt for auditing
+func recordAttempt(ctx context.Context, db *mongo.Database, attempt Attempt) error {
+	ctx, cancel := database.Query(ctx)
+
+	defer cancel()
+
+	_, err := db.Collection("loginAttempts").InsertOne(ctx, attempt)
+	return err
+}
+
+// createAttemptIndexes creates indexes of the login attempts collection,
+// attempts expire after attemptRetention
+func createAttemptIndexes(db *mongo.Database) error {
+	collection := db.Collection("loginAttempts")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{
+			primitive.E{Key: "username", Value: 1},
+			primitive.E{Key: "result", Value: 1},
+			primitive.E{Key: "date", Value: -1},
+		}},
+		{Keys: bson.D{
+			primitive.E{Key: "ip", Value: 1},
+			primitive.E{Key: "result", Value: 1},
+			primitive.E{Key: "date", Value: -1},
+		}},
+		{
+			Keys:    bson.D{primitive.E{Key: "date", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(attemptRetention.Seconds())),
+		},
+	})
+	return err
+}
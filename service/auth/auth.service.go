@@ -3,34 +3,44 @@ package auth
 import (
 	"context"
 	"encoding/json"
+	"jt-api/apierror"
+	"jt-api/background"
+	"jt-api/config"
+	"jt-api/database"
+	"jt-api/logger"
+	"jt-api/ratelimit"
+	"jt-api/service/notification"
+	"jt-api/service/users"
+	"log/slog"
+	"math"
 	"net/http"
-	"os"
+	"strconv"
 	"time"
 
+	"firebase.google.com/go/messaging"
 	"github.com/dgrijalva/jwt-go"
-
-	"jt-api/service/users"
-
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"golang.org/x/crypto/bcrypt"
 )
 
 // LoginUser login user model
 type LoginUser struct {
-	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
-	Fullname  string             `json:"fullname,omitempty" bson:"fullname,omitempty"`
-	Username  string             `json:"username,omitempty" bson:"username,omitempty"`
-	Password  string             `json:"password,omitempty" bson:"password,omitempty"`
-	Email     string             `json:"email,omitempty" bson:"email,omitempty"`
-	Image     string             `json:"image,omitempty" bson:"image,omitempty"`
-	Bio       string             `json:"bio" bson:"bio"`
-	Verified  bool               `json:"verified" bson:"verified"`
-	Type      int                `json:"type" bson:"type"`
-	Followers int                `json:"followers" bson:"followers"`
-	Follows   int                `json:"follows" bson:"follows"`
+	ID            primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Fullname      string             `json:"fullname,omitempty" bson:"fullname,omitempty"`
+	Username      string             `json:"username,omitempty" bson:"username,omitempty"`
+	Password      string             `json:"password,omitempty" bson:"password,omitempty"`
+	Email         string             `json:"email,omitempty" bson:"email,omitempty"`
+	Image         string             `json:"image,omitempty" bson:"image,omitempty"`
+	Bio           string             `json:"bio" bson:"bio"`
+	Verified      bool               `json:"verified" bson:"verified"`
+	EmailVerified bool               `json:"emailVerified" bson:"emailVerified"`
+	Type          int                `json:"type" bson:"type"`
+	Followers     int                `json:"followers" bson:"followers"`
+	Follows       int                `json:"follows" bson:"follows"`
+	Language      string             `json:"language,omitempty" bson:"language,omitempty"`
+	TokenVersion  int                `json:"-" bson:"tokenVersion"`
 }
 
 // LoginResponse response model for user login
@@ -39,21 +49,58 @@ type LoginResponse struct {
 	User  LoginUser `json:"user,omitempty" bson:"user,omitempty"`
 }
 
-// Login authenticates user
-func Login(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+// Credentials is the body of a login, username may also be an email and
+// neither is case sensitive
+type Credentials struct {
+	Username string `json:"username,omitempty"`
+	Email    string `json:"email,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// CreateIndexes creates indexes of the login attempts and password resets
+// collections
+func CreateIndexes(db *mongo.Database) error {
+	if err := createAttemptIndexes(db); err != nil {
+		return err
+	}
+	return createResetIndexes(db)
+}
+
+// dummyHash is compared against when the user does not exist, so a missing
+// user takes as long as a wrong password
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), 5)
+
+// Login authenticates user by username or email
+//
+// Unknown users and wrong passwords get the same response. Failures are
+// throttled per account and per IP, growing delays are followed by a lockout
+// and the owner of the account is notified when it is locked
+func Login(db *mongo.Database, conf config.Server) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 
-		var user users.User
-		json.NewDecoder(request.Body).Decode(&user)
+		var credentials Credentials
+		if err := json.NewDecoder(request.Body).Decode(&credentials); err != nil {
+			apierror.Write(response, request, apierror.InvalidBody)
+			return
+		}
 
-		collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		identifier := credentials.Username
+		if identifier == "" {
+			identifier = credentials.Email
+		}
+		if identifier == "" || credentials.Password == "" {
+			apierror.Write(response, request, apierror.MissingFields)
+			return
+		}
+
+		collection := db.Collection("users")
+		ctx, cancel := database.Query(request.Context())
 
 		defer cancel()
 
 		match := bson.D{
-			primitive.E{Key: "$match", Value: bson.D{primitive.E{Key: "username", Value: user.Username}}},
+			primitive.E{Key: "$match", Value: users.IdentifierFilter(identifier)},
 		}
 
 		project := bson.D{
@@ -69,58 +116,131 @@ func Login(db *mongo.Client) func(response http.ResponseWriter, request *http.Re
 					primitive.E{Key: "bio", Value: "$bio"},
 					primitive.E{Key: "type", Value: "$type"},
 					primitive.E{Key: "verified", Value: "$verified"},
-					primitive.E{Key: "followers", Value: bson.D{
-						primitive.E{Key: "$size", Value: "$followers"},
-					}},
-					primitive.E{Key: "follows", Value: bson.D{
-						primitive.E{Key: "$size", Value: "$follows"},
-					}},
+					primitive.E{Key: "emailVerified", Value: "$emailVerified"},
+					primitive.E{Key: "followers", Value: "$followerCount"},
+					primitive.E{Key: "follows", Value: "$followCount"},
+					primitive.E{Key: "language", Value: "$language"},
+					primitive.E{Key: "tokenVersion", Value: "$tokenVersion"},
 				},
 			},
 		}
-		opts := options.Aggregate().SetMaxTime(2 * time.Second)
+		opts := database.Aggregate()
 
 		cursor, err := collection.Aggregate(ctx, mongo.Pipeline{match, project}, opts)
 		if err != nil {
-			response.WriteHeader(http.StatusInternalServerError)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.WriteError(response, request, err)
 			return
 		}
 
 		var results []LoginUser
-		if err = cursor.All(context.TODO(), &results); err != nil {
-			response.WriteHeader(http.StatusInternalServerError)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+		if err = cursor.All(ctx, &results); err != nil {
+			apierror.WriteError(response, request, err)
 			return
 		}
 
+		// Failures of an account are counted under its username whether it
+		// was given or its email was, so switching between them does not
+		// reset the count
+		attempt := Attempt{
+			Username:  users.Canonical(identifier),
+			IP:        ratelimit.ClientIP(request, conf.ClientIPHeader),
+			UserAgent: request.UserAgent(),
+			Date:      primitive.NewDateTimeFromTime(time.Now()),
+		}
 		if len(results) > 0 {
-			err = bcrypt.CompareHashAndPassword([]byte((results[0].Password)), []byte(user.Password))
-			if err != nil {
-				response.WriteHeader(http.StatusBadRequest)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
-				return
+			attempt.Username = users.Canonical(results[0].Username)
+			attempt.User = results[0].ID
+		}
+		log := logger.FromRequest(request)
+
+		// Attempts are recorded even when the client goes away, otherwise
+		// dropping connections would dodge the throttle
+		followup := context.WithoutCancel(request.Context())
+		record := func(result string) {
+			attempt.Result = result
+			if err := recordAttempt(followup, db, attempt); err != nil {
+				log.Error("Failed to record login attempt", "error", err)
 			}
+		}
+
+		attempts := db.Collection("loginAttempts")
+		now := attempt.Date.Time()
+
+		accountWait, accountFailures, err := accountThrottle.wait(ctx, attempts, attempt.Username, now)
+		if err != nil {
+			apierror.WriteError(response, request, err)
+			return
+		}
+		ipWait, _, err := ipThrottle.wait(ctx, attempts, attempt.IP, now)
+		if err != nil {
+			apierror.WriteError(response, request, err)
+			return
+		}
+
+		if wait := max(accountWait, ipWait); wait > 0 {
+			record(attemptLocked)
+			response.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			apierror.Write(response, request, apierror.LoginLocked)
+			return
+		}
+
+		if len(results) == 0 {
+			bcrypt.CompareHashAndPassword(dummyHash, []byte(credentials.Password))
+			record(attemptFailed)
+			apierror.Write(response, request, apierror.InvalidCredentials)
+			return
+		}
+
+		found := results[0]
 
-			results[0].Password = ""
+		if err = bcrypt.CompareHashAndPassword([]byte(found.Password), []byte(credentials.Password)); err != nil {
+			record(attemptFailed)
 
-			token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-				"user": results[0],
-			})
-			tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
-			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
-				return
+			if accountFailures+1 == accountThrottle.lockAfter {
+				log.Warn("Account locked after failed logins", "username", attempt.Username, "ip", attempt.IP)
+				background.Go(func() {
+					notifyLocked(followup, db, found, log)
+				})
 			}
 
-			result := LoginResponse{User: results[0], Token: tokenString}
+			apierror.Write(response, request, apierror.InvalidCredentials)
+			return
+		}
+
+		record(attemptSucceeded)
+
+		found.Password = ""
 
-			json.NewEncoder(response).Encode(result)
-		} else {
-			response.WriteHeader(http.StatusNotFound)
-			response.Write([]byte(`{ "message": "Not Found" }`))
+		// The version is bumped when the password is reset, which signs out
+		// tokens carrying an older one
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+			"user":    found,
+			"version": found.TokenVersion,
+		})
+		tokenString, err := token.SignedString([]byte(conf.JWTSecret))
+		if err != nil {
+			apierror.WriteError(response, request, err)
 			return
 		}
+
+		result := LoginResponse{User: found, Token: tokenString}
+
+		json.NewEncoder(response).Encode(result)
+	}
+}
+
+// notifyLocked tells user that logins to their account are paused
+func notifyLocked(ctx context.Context, db *mongo.Database, user LoginUser, log *slog.Logger) {
+	language, ok := config.Languages[user.Language]
+	if !ok {
+		language = config.Languages[apierror.DefaultLanguage]
+	}
+
+	err := notification.SendNotification(ctx, user.ID, messaging.Notification{
+		Title: language.LoginLocked(),
+		Body:  language.LoginLockedFor(strconv.Itoa(int(lockDuration.Minutes()))),
+	}, db)
+	if err != nil {
+		log.Error("Failed to notify locked account", "error", err)
 	}
 }
@@ -0,0 +1,240 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"jt-api/apierror"
+	"jt-api/background"
+	"jt-api/config"
+	"jt-api/database"
+	"jt-api/logger"
+	"jt-api/mail"
+	"jt-api/service/users"
+	"jt-api/validation"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Reset is a pending password reset, only the hash of its token is kept so
+// a leaked collection can not be used to reset passwords
+type Reset struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty"`
+	User    primitive.ObjectID `bson:"user"`
+	Hash    string             `bson:"hash"`
+	Expires primitive.DateTime `bson:"expires"`
+}
+
+// ForgotRequest is the body of a password reset request, username may also
+// be an email
+type ForgotRequest struct {
+	Username string `json:"username,omitempty"`
+	Email    string `json:"email,omitempty"`
+}
+
+// ResetRequest is the body of a password reset
+type ResetRequest struct {
+	Token    string `json:"token,omitempty" validate:"required"`
+	Password string `json:"password,omitempty" validate:"required,password"`
+}
+
+// hashToken returns the hash a reset token is stored by, tokens are random
+// so a plain hash is enough
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ForgotPassword mails a single use reset link to the user with given
+// username or email
+//
+// The response is the same whether the user exists or not and the mail is
+// sent in the background, so neither the response nor its timing tells
+// which users exist
+func ForgotPassword(db *mongo.Database, conf config.Server, sender mail.Sender) func(response http.ResponseWriter, request *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+
+		var body ForgotRequest
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			apierror.Write(response, request, apierror.InvalidBody)
+			return
+		}
+
+		identifier := body.Username
+		if identifier == "" {
+			identifier = body.Email
+		}
+		if identifier == "" {
+			apierror.Write(response, request, apierror.MissingFields)
+			return
+		}
+
+		ctx := context.WithoutCancel(request.Context())
+		log := logger.FromRequest(request)
+		background.Go(func() {
+			ctx, cancel := context.WithTimeout(ctx, mail.Timeout)
+
+			defer cancel()
+
+			if err := sendReset(ctx, db, conf, sender, identifier); err != nil {
+				log.Error("Failed to send password reset", "error", err)
+			}
+		})
+
+		response.Write([]byte(`{ "message": "OK" }`))
+	}
+}
+
+// sendReset replaces pending resets of the user with given identifier by a
+// new one and mails its link, nothing happens when there is no such user
+func sendReset(ctx context.Context, db *mongo.Database, conf config.Server, sender mail.Sender, identifier string) error {
+	queryCtx, cancel := database.Query(ctx)
+
+	defer cancel()
+
+	var user struct {
+		ID       primitive.ObjectID `bson:"_id"`
+		Email    string             `bson:"email"`
+		Language string             `bson:"language"`
+	}
+	opts := options.FindOne().SetProjection(bson.D{
+		primitive.E{Key: "email", Value: 1},
+		primitive.E{Key: "language", Value: 1},
+	})
+	err := db.Collection("users").FindOne(queryCtx, users.IdentifierFilter(identifier), opts).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	random := make([]byte, 32)
+	if _, err = rand.Read(random); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(random)
+
+	collection := db.Collection("passwordResets")
+	if _, err = collection.DeleteMany(queryCtx, bson.D{primitive.E{Key: "user", Value: user.ID}}); err != nil {
+		return err
+	}
+	_, err = collection.InsertOne(queryCtx, Reset{
+		User:    user.ID,
+		Hash:    hashToken(token),
+		Expires: primitive.NewDateTimeFromTime(time.Now().Add(conf.PasswordResetTTL)),
+	})
+	if err != nil {
+		return err
+	}
+
+	texts, ok := config.Languages[user.Language]
+	if !ok {
+		texts = config.Languages[apierror.DefaultLanguage]
+	}
+
+	link := conf.AppURL + "/reset-password?token=" + url.QueryEscape(token)
+	return sender.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: texts.ResetPassword(),
+		Body:    texts.ResetLinkAt(link),
+	})
+}
+
+// ResetPassword sets the password of the user the token was mailed to, the
+// token is used up and every session of the user is signed out
+func ResetPassword(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+
+		var body ResetRequest
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			apierror.Write(response, request, apierror.InvalidBody)
+			return
+		}
+		if err := validation.Struct(body); err != nil {
+			apierror.WriteError(response, request, err)
+			return
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(body.Password), 5)
+		if err != nil {
+			apierror.WriteError(response, request, err)
+			return
+		}
+
+		ctx, cancel := database.Query(request.Context())
+
+		defer cancel()
+
+		// Deleting the reset as it is read makes it single use even when the
+		// same token is sent twice at once
+		var reset Reset
+		err = db.Collection("passwordResets").FindOneAndDelete(ctx, bson.D{
+			primitive.E{Key: "hash", Value: hashToken(body.Token)},
+			primitive.E{Key: "expires", Value: bson.D{primitive.E{Key: "$gt", Value: primitive.NewDateTimeFromTime(time.Now())}}},
+		}).Decode(&reset)
+		if err == mongo.ErrNoDocuments {
+			apierror.Write(response, request, apierror.InvalidToken)
+			return
+		}
+		if err != nil {
+			apierror.WriteError(response, request, err)
+			return
+		}
+
+		// The reset is gone once read, so the password is set even if the
+		// client goes away
+		ctx, cancelUpdate := database.Query(context.WithoutCancel(ctx))
+
+		defer cancelUpdate()
+
+		result, err := db.Collection("users").UpdateOne(ctx, bson.D{primitive.E{Key: "_id", Value: reset.User}}, bson.D{
+			primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "password", Value: string(hash)}}},
+			primitive.E{Key: "$inc", Value: bson.D{primitive.E{Key: "tokenVersion", Value: 1}}},
+		})
+		if err != nil {
+			apierror.WriteError(response, request, err)
+			return
+		}
+		if result.MatchedCount == 0 {
+			apierror.Write(response, request, apierror.InvalidToken)
+			return
+		}
+
+		response.Write([]byte(`{ "message": "OK" }`))
+	}
+}
+
+// createResetIndexes creates indexes of the password resets collection,
+// resets are removed by the database once they expire
+func createResetIndexes(db *mongo.Database) error {
+	collection := db.Collection("passwordResets")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{primitive.E{Key: "hash", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{primitive.E{Key: "user", Value: 1}}},
+		{
+			Keys:    bson.D{primitive.E{Key: "expires", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
@@ -3,12 +3,16 @@ package comments
 import (
 	"context"
 	"encoding/json"
+	"jt-api/apierror"
 	"jt-api/config"
+	"jt-api/database"
+	"jt-api/edges"
+	"jt-api/logger"
+	"jt-api/pagination"
 	"jt-api/service/notification"
-	"log"
+	"jt-api/validation"
+	"jt-api/views"
 	"net/http"
-	"os"
-	"strconv"
 	"time"
 
 	"firebase.google.com/go/messaging"
@@ -21,20 +25,28 @@ import (
 
 // CreateCommentModel common comment model for creating new comment
 type CreateCommentModel struct {
-	ID     primitive.ObjectID `json:"_id" bson:"_id"`
-	Answer Comment            `json:"answer" bson:"answer"`
+	ID     primitive.ObjectID `json:"_id" bson:"_id" validate:"required"`
+	Answer Comment            `json:"answer" bson:"answer" validate:"dive"`
 }
 
 // Comment common comment model
 type Comment struct {
-	ID      primitive.ObjectID    `json:"_id,omitempty" bson:"_id,omitempty"`
-	Post    primitive.ObjectID    `json:"post,omitempty" bson:"post,omitempty"`
-	Author  primitive.ObjectID    `json:"author,omitempty" bson:"author,omitempty"`
-	Date    primitive.DateTime    `json:"date,omitempty" bson:"date,omitempty"`
-	Parent  primitive.ObjectID    `json:"parent" bson:"parent"`
-	Content *[]interface{}        `json:"content" bson:"content"`
-	Upvotes *[]primitive.ObjectID `json:"upvotes" bson:"upvotes"`
-	Answers *[]Comment            `json:"answers" bson:"answers"`
+	ID      primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Post    primitive.ObjectID `json:"post,omitempty" bson:"post,omitempty"`
+	Author  primitive.ObjectID `json:"author,omitempty" bson:"author,omitempty"`
+	Date    primitive.DateTime `json:"date,omitempty" bson:"date,omitempty"`
+	Parent  primitive.ObjectID `json:"parent" bson:"parent"`
+	Content *[]interface{}     `json:"content" bson:"content" validate:"required,max=100"`
+	Answers *[]Comment         `json:"answers" bson:"answers"`
+
+	UpvoteCount int `json:"upvoteCount" bson:"upvoteCount"`
+	AnswerCount int `json:"answerCount" bson:"answerCount"`
+}
+
+// Comments are listed by upvotes and then by their answer counts
+var mostUpvoted = []pagination.SortField{
+	{Key: "upvotes", Order: -1, Kind: pagination.Number, Field: "upvoteCount"},
+	{Key: "answers", Order: -1, Kind: pagination.Number, Field: "answerCount"},
 }
 
 // CommentActionModel is model for upvoting and downvoting actions
@@ -43,20 +55,18 @@ type CommentActionModel struct {
 }
 
 // GetComments fetch comments of a post from database
-func GetComments(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func GetComments(db *mongo.Database, conf config.Server) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 		params := mux.Vars(request)
-		page, err := strconv.Atoi(params["page"])
+		page, err := pagination.FromRequest(request, conf.CommentLimit, mostUpvoted)
 		if err != nil {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.Write(response, request, apierror.InvalidPage)
 			return
 		}
-		commentLimit, _ := strconv.Atoi(os.Getenv("COMMENT_LIMIT"))
 
-		collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("comments")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		collection := db.Collection("comments")
+		ctx, cancel := database.Query(request.Context())
 
 		defer cancel()
 
@@ -67,8 +77,7 @@ func GetComments(db *mongo.Client) func(response http.ResponseWriter, request *h
 
 			id, err := primitive.ObjectIDFromHex(params["id"])
 			if err != nil {
-				response.WriteHeader(http.StatusBadRequest)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.Write(response, request, apierror.InvalidID)
 				return
 			}
 
@@ -90,100 +99,48 @@ func GetComments(db *mongo.Client) func(response http.ResponseWriter, request *h
 						primitive.E{Key: "content", Value: "$content"},
 						primitive.E{Key: "date", Value: "$date"},
 						primitive.E{Key: "post", Value: "$post"},
-						primitive.E{Key: "upvoted", Value: bson.D{
-							primitive.E{Key: "$in", Value: []interface{}{oID, "$upvotes"}},
-						}},
-						primitive.E{Key: "answers", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$answers"},
-						}},
-						primitive.E{Key: "upvotes", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$upvotes"},
-						}},
-					},
-				},
-			}
-
-			lookup := bson.D{
-				primitive.E{
-					Key: "$lookup",
-					Value: bson.M{
-						"from":         "users",
-						"localField":   "author",
-						"foreignField": "_id",
-						"as":           "author",
+						primitive.E{Key: "answers", Value: "$answerCount"},
+						primitive.E{Key: "upvotes", Value: "$upvoteCount"},
 					},
 				},
 			}
 
-			sort := bson.D{
-				primitive.E{
-					Key: "$sort",
-					Value: bson.D{primitive.E{
-						Key:   "upvotes",
-						Value: -1,
-					}, primitive.E{
-						Key:   "answers",
-						Value: -1,
-					}},
-				},
-			}
-
-			skip := bson.D{
-				primitive.E{
-					Key:   "$skip",
-					Value: (page - 1) * commentLimit,
-				},
-			}
-
-			limit := bson.D{
-				primitive.E{
-					Key:   "$limit",
-					Value: commentLimit,
-				},
-			}
+			opts := database.Aggregate()
 
-			opts := options.Aggregate().SetMaxTime(2 * time.Second)
+			pipeline := mongo.Pipeline{match}
+			pipeline = append(pipeline, page.Match()...)
+			pipeline = append(pipeline, project)
+			pipeline = append(pipeline, page.Stages()...)
+			pipeline = append(pipeline, edges.Flag(edges.Vote, oID, "upvoted")...)
+			pipeline = append(pipeline, views.LookupUser("author")...)
 
-			cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
-				match,
-				project,
-				lookup,
-				sort,
-				skip,
-				limit,
-			}, opts)
+			cursor, err := collection.Aggregate(ctx, pipeline, opts)
 
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.WriteError(response, request, err)
 				return
 			}
 
-			results := []bson.M{}
-			if err = cursor.All(context.TODO(), &results); err != nil {
-				log.Fatal(err)
-			}
-
-			mapped := make([]bson.M, len(results))
-			for i, v := range results {
-				v["author"] = formatAuthor(v["author"].(primitive.A)[0].(primitive.M))
-				mapped[i] = v
+			results := []views.CommentView{}
+			if err = cursor.All(ctx, &results); err != nil {
+				apierror.WriteError(response, request, err)
+				return
 			}
 
-			json.NewEncoder(response).Encode(mapped)
+			page.Write(response, results)
 		}
 	}
 }
 
 // CreateComment create comment and register to database
-func CreateComment(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func CreateComment(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 
-		postsCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("posts")
-		commentsCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("comments")
-		usersCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		postsCollection := db.Collection("posts")
+		commentsCollection := db.Collection("comments")
+		usersCollection := db.Collection("users")
+		ctx, cancel := database.Query(request.Context())
 
 		defer cancel()
 
@@ -196,20 +153,12 @@ func CreateComment(db *mongo.Client) func(response http.ResponseWriter, request
 			err := json.NewDecoder(request.Body).Decode(&comment)
 
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.Write(response, request, apierror.InvalidBody)
 				return
 			}
 
-			if comment.ID.Hex() == "000000000000000000000000" {
-				response.WriteHeader(http.StatusBadRequest)
-				response.Write([]byte(`{ "message": "PostID is not given" }`))
-				return
-			}
-
-			if comment.Answer.Content == nil {
-				response.WriteHeader(http.StatusBadRequest)
-				response.Write([]byte(`{ "message": "Content is not given" }`))
+			if err = validation.Struct(comment); err != nil {
+				apierror.WriteError(response, request, err)
 				return
 			}
 
@@ -217,10 +166,10 @@ func CreateComment(db *mongo.Client) func(response http.ResponseWriter, request
 			comment.Answer.Author = oID
 			comment.Answer.Post = comment.ID
 			comment.Answer.Date = primitive.NewDateTimeFromTime(time.Now())
-			comment.Answer.Upvotes = &[]primitive.ObjectID{}
 			comment.Answer.Answers = &[]Comment{}
+			comment.Answer.UpvoteCount = 0
+			comment.Answer.AnswerCount = 0
 
-			opts := options.FindOneAndUpdate().SetUpsert(true)
 			filter := bson.D{
 				primitive.E{Key: "_id", Value: comment.ID},
 			}
@@ -232,10 +181,27 @@ func CreateComment(db *mongo.Client) func(response http.ResponseWriter, request
 						Value: comment.Answer.ID,
 					}},
 				},
+				primitive.E{Key: "$inc", Value: bson.D{primitive.E{Key: "answerCount", Value: 1}}},
 			}
 
-			postsCollection.FindOneAndUpdate(ctx, filter, update, opts)
-			commentsCollection.InsertOne(ctx, comment.Answer)
+			updated, err := postsCollection.UpdateOne(ctx, filter, update)
+			if err != nil {
+				apierror.WriteError(response, request, err)
+				return
+			}
+			if updated.MatchedCount == 0 {
+				apierror.Write(response, request, apierror.PostNotFound)
+				return
+			}
+
+			if _, err = commentsCollection.InsertOne(ctx, comment.Answer); err != nil {
+				postsCollection.UpdateOne(ctx, filter, bson.D{
+					primitive.E{Key: "$pull", Value: bson.D{primitive.E{Key: "answers", Value: comment.Answer.ID}}},
+					primitive.E{Key: "$inc", Value: bson.D{primitive.E{Key: "answerCount", Value: -1}}},
+				})
+				apierror.WriteError(response, request, err)
+				return
+			}
 
 			// Send notification
 			var commentator, commentee, post bson.M
@@ -254,7 +220,7 @@ func CreateComment(db *mongo.Client) func(response http.ResponseWriter, request
 			usersCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: post["author"]}}, notificationOpts).Decode(&commentee)
 
 			if commentator["_id"] != commentee["_id"] {
-				notification.SendNotification(post["author"].(primitive.ObjectID), messaging.Notification{
+				notification.SendNotification(request.Context(), post["author"].(primitive.ObjectID), messaging.Notification{
 					Title: config.Languages[commentee["language"].(string)].NewComment(),
 					Body:  config.Languages[commentee["language"].(string)].PostComment(commentator["fullname"].(string) + " (@" + commentator["username"].(string) + ")"),
 				}, db)
@@ -266,14 +232,14 @@ func CreateComment(db *mongo.Client) func(response http.ResponseWriter, request
 }
 
 // DeleteComment delete comment from database
-func DeleteComment(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func DeleteComment(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 		params := mux.Vars(request)
 
-		commentsCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("comments")
-		postsCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("posts")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		commentsCollection := db.Collection("comments")
+		postsCollection := db.Collection("posts")
+		ctx, cancel := database.Query(request.Context())
 
 		defer cancel()
 
@@ -284,8 +250,7 @@ func DeleteComment(db *mongo.Client) func(response http.ResponseWriter, request
 
 			id, err := primitive.ObjectIDFromHex(params["id"])
 			if err != nil {
-				response.WriteHeader(http.StatusBadRequest)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.Write(response, request, apierror.InvalidID)
 				return
 			}
 
@@ -298,30 +263,42 @@ func DeleteComment(db *mongo.Client) func(response http.ResponseWriter, request
 			commentsCollection.FindOne(ctx, filter, opts).Decode(&result)
 
 			if result["author"] == nil {
-				response.WriteHeader(http.StatusNotFound)
-				response.Write([]byte(`{ "message": "Comment Not Found" }`))
+				apierror.Write(response, request, apierror.CommentNotFound)
 				return
 			}
 
 			if result["author"] != oID {
-				response.WriteHeader(http.StatusUnauthorized)
-				response.Write([]byte(`{ "message": "Unauthorized" }`))
+				apierror.Write(response, request, apierror.Forbidden)
 				return
 			}
 
-			updateOpts := options.FindOneAndUpdate().SetUpsert(true)
-			update := bson.D{primitive.E{
-				Key: "$pull", Value: bson.D{primitive.E{Key: "answers", Value: id}},
-			}}
+			// Once deleting starts it has to finish even if the client goes away
+			followup, cancelFollowup := database.Query(context.WithoutCancel(request.Context()))
+
+			defer cancelFollowup()
 
-			postsCollection.FindOneAndUpdate(
-				ctx,
-				bson.D{primitive.E{Key: "_id", Value: result["post"]}},
-				update,
-				updateOpts,
-			)
+			// Only the request that deleted the comment moves the answer count
+			deleted, err := commentsCollection.DeleteOne(followup, filter)
+			if err != nil {
+				apierror.WriteError(response, request, err)
+				return
+			}
 
-			commentsCollection.FindOneAndDelete(ctx, filter)
+			if deleted.DeletedCount > 0 {
+				update := bson.D{
+					primitive.E{Key: "$pull", Value: bson.D{primitive.E{Key: "answers", Value: id}}},
+					primitive.E{Key: "$inc", Value: bson.D{primitive.E{Key: "answerCount", Value: -1}}},
+				}
+
+				_, err = postsCollection.UpdateOne(followup, bson.D{primitive.E{Key: "_id", Value: result["post"]}}, update)
+				if err != nil {
+					logger.FromRequest(request).Error("Failed to update answer count", "error", err)
+				}
+			}
+
+			if err = edges.RemoveAll(followup, db, edges.Vote, edges.Vote.To, id); err != nil {
+				logger.FromRequest(request).Error("Failed to remove comment votes", "error", err)
+			}
 
 			response.Write([]byte(`{ "message": "OK" }`))
 		}
@@ -330,7 +307,7 @@ func DeleteComment(db *mongo.Client) func(response http.ResponseWriter, request
 }
 
 // CommentAction is for upvoting and downvoting posts
-func CommentAction(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func CommentAction(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 		actionType := mux.Vars(request)["type"]
@@ -344,61 +321,94 @@ func CommentAction(db *mongo.Client) func(response http.ResponseWriter, request
 
 			if err == nil {
 				if actionType == "upvote" {
-					upvote(db, response, request, oID, action.ID)
+					setUpvote(db, response, request, oID, action.ID, true)
 					return
 				} else if actionType == "downvote" {
-					downvote(db, response, request, oID, action.ID)
+					setUpvote(db, response, request, oID, action.ID, false)
 					return
 				}
 			} else {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.Write(response, request, apierror.InvalidBody)
 				return
 			}
 
 		}
 
-		response.WriteHeader(http.StatusNotFound)
-		response.Write([]byte(`{ "message": "Not Found" }`))
+		apierror.Write(response, request, apierror.NotFound)
 		return
 	}
 }
 
-func upvote(
-	db *mongo.Client,
+// Upvote upvotes given comment on PUT and takes the upvote back on DELETE,
+// repeated requests leave the comment as it is and respond the same
+func Upvote(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+		params := mux.Vars(request)
+
+		id, err := primitive.ObjectIDFromHex(params["id"])
+		if err != nil {
+			apierror.Write(response, request, apierror.InvalidID)
+			return
+		}
+
+		authID, _, ok := request.BasicAuth()
+
+		if ok {
+			oID, _ := primitive.ObjectIDFromHex(authID)
+			setUpvote(db, response, request, oID, id, request.Method == http.MethodPut)
+		}
+	}
+}
+
+// setUpvote brings upvote of upvoterID on commentID to given state and
+// responds the resulting state of the comment
+func setUpvote(
+	db *mongo.Database,
 	response http.ResponseWriter,
 	request *http.Request,
 	upvoterID primitive.ObjectID,
 	commentID primitive.ObjectID,
-) error {
-	collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("comments")
-	usersCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	upvoted bool,
+) {
+	collection := db.Collection("comments")
+	usersCollection := db.Collection("users")
+	ctx, cancel := database.Query(request.Context())
 
 	defer cancel()
 
-	results := upvoted(db, response, request, upvoterID, commentID)
-
-	if len(results) > 0 {
-		if results[0]["upvoted"].(bool) {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "Comment already upvoted" }`))
-			return nil
-		}
-		updateOpts := options.FindOneAndUpdate().SetUpsert(true)
-
-		filter := bson.D{primitive.E{Key: "_id", Value: commentID}}
-		update := bson.D{primitive.E{
-			Key: "$push", Value: bson.D{primitive.E{Key: "upvotes", Value: upvoterID}},
-		}}
-		collection.FindOneAndUpdate(ctx, filter, update, updateOpts)
+	changed, err := edges.Set(request.Context(), db, edges.Vote, upvoterID, commentID, upvoted, edges.Counter{
+		Collection: "comments",
+		ID:         commentID,
+		Field:      "upvoteCount",
+	})
+	if err == edges.ErrNotFound {
+		apierror.Write(response, request, apierror.CommentNotFound)
+		return
+	}
+	if err != nil {
+		apierror.WriteError(response, request, err)
+		return
+	}
 
-		// Send notification
-		var upvoter, upvotee, post bson.M
+	var comment bson.M
+	readOpts := options.FindOne().SetProjection(bson.D{
+		primitive.E{Key: "author", Value: "$author"},
+		primitive.E{Key: "upvoteCount", Value: "$upvoteCount"},
+	})
+	err = collection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: commentID}}, readOpts).Decode(&comment)
+	if err == mongo.ErrNoDocuments {
+		apierror.Write(response, request, apierror.CommentNotFound)
+		return
+	}
+	if err != nil {
+		apierror.WriteError(response, request, err)
+		return
+	}
 
-		readOpts := options.FindOne().SetProjection(bson.D{primitive.E{Key: "author", Value: "$author"}})
-		filter = bson.D{primitive.E{Key: "_id", Value: commentID}}
-		collection.FindOne(ctx, filter, readOpts).Decode(&post)
+	// Send notification
+	if changed && upvoted {
+		var upvoter, upvotee bson.M
 
 		opts := options.FindOne().SetProjection(bson.D{
 			primitive.E{Key: "_id", Value: "$_id"},
@@ -407,111 +417,18 @@ func upvote(
 			primitive.E{Key: "language", Value: "$language"},
 		})
 		usersCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: upvoterID}}, opts).Decode(&upvoter)
-		usersCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: post["author"]}}, opts).Decode(&upvotee)
+		usersCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: comment["author"]}}, opts).Decode(&upvotee)
 
 		if upvoter["_id"] != upvotee["_id"] {
-			notification.SendNotification(post["author"].(primitive.ObjectID), messaging.Notification{
+			notification.SendNotification(request.Context(), comment["author"].(primitive.ObjectID), messaging.Notification{
 				Title: config.Languages[upvotee["language"].(string)].UpvoteTitle(),
 				Body:  config.Languages[upvotee["language"].(string)].CommentUpvote(upvoter["fullname"].(string) + " (@" + upvoter["username"].(string) + ")"),
 			}, db)
 		}
-
-		response.Write([]byte(`{ "message": "OK" }`))
-		return nil
 	}
 
-	response.WriteHeader(http.StatusNotFound)
-	response.Write([]byte(`{ "message": "Comment Not Found" }`))
-	return nil
-}
-
-func downvote(
-	db *mongo.Client,
-	response http.ResponseWriter,
-	request *http.Request,
-	upvoterID primitive.ObjectID,
-	commentID primitive.ObjectID,
-) error {
-	collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("comments")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-
-	defer cancel()
-
-	results := upvoted(db, response, request, upvoterID, commentID)
-
-	if len(results) > 0 {
-		if results[0]["upvoted"].(bool) == false {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "Comment already downvoted" }`))
-			return nil
-		}
-		updateOpts := options.FindOneAndUpdate().SetUpsert(true)
-
-		filter := bson.D{primitive.E{Key: "_id", Value: commentID}}
-		update := bson.D{primitive.E{
-			Key: "$pull", Value: bson.D{primitive.E{Key: "upvotes", Value: upvoterID}},
-		}}
-		collection.FindOneAndUpdate(ctx, filter, update, updateOpts)
-
-		response.Write([]byte(`{ "message": "OK" }`))
-		return nil
-	}
-
-	response.WriteHeader(http.StatusNotFound)
-	response.Write([]byte(`{ "message": "Comment Not Found" }`))
-	return nil
-}
-
-func upvoted(
-	db *mongo.Client,
-	response http.ResponseWriter,
-	request *http.Request,
-	upvoterID primitive.ObjectID,
-	commentID primitive.ObjectID,
-) []bson.M {
-	collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("comments")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-
-	defer cancel()
-
-	aggregateOpts := options.Aggregate().SetMaxTime(2 * time.Second)
-	match := bson.D{
-		primitive.E{Key: "$match", Value: bson.D{primitive.E{Key: "_id", Value: commentID}}},
-	}
-	project := bson.D{
-		primitive.E{
-			Key: "$project",
-			Value: bson.D{
-				primitive.E{Key: "upvoted", Value: bson.D{
-					primitive.E{Key: "$in", Value: []interface{}{upvoterID, "$upvotes"}},
-				}},
-			},
-		},
-	}
-	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{match, project}, aggregateOpts)
-
-	if err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
-		response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
-		return nil
-	}
-
-	var results []bson.M
-	if err = cursor.All(ctx, &results); err != nil {
-		log.Fatal(err)
-	}
-
-	return results
-}
-
-func formatAuthor(author primitive.M) primitive.M {
-	result := primitive.M{}
-
-	result["_id"] = author["_id"]
-	result["fullname"] = author["fullname"]
-	result["username"] = author["username"]
-	result["image"] = author["image"]
-	result["verified"] = author["verified"]
-
-	return result
+	json.NewEncoder(response).Encode(bson.M{
+		"upvoted": upvoted,
+		"upvotes": comment["upvoteCount"],
+	})
 }
@@ -3,9 +3,14 @@ package communities
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"jt-api/apierror"
+	"jt-api/database"
+	"jt-api/edges"
+	"jt-api/logger"
+	"jt-api/pagination"
+	"jt-api/validation"
+	"jt-api/views"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -18,14 +23,15 @@ import (
 // Community common community model
 type Community struct {
 	ID      primitive.ObjectID    `json:"_id,omitempty" bson:"_id,omitempty"`
-	Title   string                `json:"title" bson:"title"`
-	Bio     string                `json:"bio" bson:"bio"`
+	Title   string                `json:"title" bson:"title" validate:"required,min=3,max=50"`
+	Bio     string                `json:"bio" bson:"bio" validate:"required,max=300"`
 	Date    primitive.DateTime    `json:"date,omitempty" bson:"date,omitempty"`
 	Founder primitive.ObjectID    `json:"founder,omitempty" bson:"founder,omitempty"`
 	Mods    *[]primitive.ObjectID `json:"mods" bson:"mods"`
-	Members *[]primitive.ObjectID `json:"members" bson:"members"`
 	Image   string                `json:"image" bson:"image"`
 	Banner  string                `json:"banner" bson:"banner"`
+
+	MemberCount int `json:"memberCount" bson:"memberCount"`
 }
 
 // CommunityActionModel is model for joining and leaving actions
@@ -34,12 +40,12 @@ type CommunityActionModel struct {
 }
 
 // CreateCommunity creates a new community and registers it to database
-func CreateCommunity(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func CreateCommunity(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 
-		collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("communities")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		collection := db.Collection("communities")
+		ctx, cancel := database.Query(request.Context())
 
 		defer cancel()
 
@@ -48,18 +54,19 @@ func CreateCommunity(db *mongo.Client) func(response http.ResponseWriter, reques
 
 		if ok {
 			var community Community
-			json.NewDecoder(request.Body).Decode(&community)
-
-			if community.Title == "" || community.Bio == "" {
-				response.WriteHeader(http.StatusBadRequest)
-				response.Write([]byte(`{ "message": "Title and bio of the community must be provided" }`))
+			if err := json.NewDecoder(request.Body).Decode(&community); err != nil {
+				apierror.Write(response, request, apierror.InvalidBody)
+				return
+			}
+			if err := validation.Struct(community); err != nil {
+				apierror.WriteError(response, request, err)
 				return
 			}
 
 			community.Founder = oID
 			community.Date = primitive.NewDateTimeFromTime(time.Now())
 			community.Mods = &[]primitive.ObjectID{oID}
-			community.Members = &[]primitive.ObjectID{oID}
+			community.MemberCount = 1
 
 			if community.Image == "" {
 				community.Image = "https://justhink.s3.eu-central-1.amazonaws.com/default-community.png"
@@ -70,18 +77,21 @@ func CreateCommunity(db *mongo.Client) func(response http.ResponseWriter, reques
 
 			result, err := collection.InsertOne(ctx, community)
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.WriteError(response, request, err)
 				return
 			}
 
+			if _, err = edges.Add(context.WithoutCancel(ctx), db, edges.Membership, oID, result.InsertedID.(primitive.ObjectID)); err != nil {
+				logger.FromRequest(request).Error("Failed to add founder membership", "error", err)
+			}
+
 			json.NewEncoder(response).Encode(result)
 		}
 	}
 }
 
 // GetCommunity fetch given community from database
-func GetCommunity(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func GetCommunity(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 		params := mux.Vars(request)
@@ -89,8 +99,7 @@ func GetCommunity(db *mongo.Client) func(response http.ResponseWriter, request *
 		authID, _, ok := request.BasicAuth()
 		id, err := primitive.ObjectIDFromHex(params["id"])
 		if err != nil {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.Write(response, request, apierror.InvalidID)
 			return
 		}
 
@@ -100,13 +109,12 @@ func GetCommunity(db *mongo.Client) func(response http.ResponseWriter, request *
 			err := json.NewDecoder(request.Body).Decode(&action)
 
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.Write(response, request, apierror.InvalidBody)
 				return
 			}
 
-			collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("communities")
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			collection := db.Collection("communities")
+			ctx, cancel := database.Query(request.Context())
 
 			defer cancel()
 
@@ -129,62 +137,73 @@ func GetCommunity(db *mongo.Client) func(response http.ResponseWriter, request *
 						primitive.E{Key: "banner", Value: "$banner"},
 						primitive.E{Key: "bio", Value: "$bio"},
 						primitive.E{Key: "founder", Value: "$founder"},
-						primitive.E{Key: "joined", Value: bson.D{
-							primitive.E{Key: "$in", Value: []interface{}{oID, "$members"}},
-						}},
-						primitive.E{Key: "members", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$members"},
-						}},
+						primitive.E{Key: "members", Value: "$memberCount"},
 					},
 				},
 			}
 
-			lookup := bson.D{
-				primitive.E{
-					Key: "$lookup",
-					Value: bson.M{
-						"from":         "users",
-						"localField":   "founder",
-						"foreignField": "_id",
-						"as":           "founder",
-					},
-				},
-			}
+			opts := database.Aggregate()
 
-			opts := options.Aggregate().SetMaxTime(2 * time.Second)
+			pipeline := mongo.Pipeline{match, project}
+			pipeline = append(pipeline, edges.Flag(edges.Membership, oID, "joined")...)
+			pipeline = append(pipeline, views.LookupUser("founder")...)
 
-			cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
-				match,
-				project,
-				lookup,
-			}, opts)
+			cursor, err := collection.Aggregate(ctx, pipeline, opts)
 
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.WriteError(response, request, err)
 				return
 			}
 
-			results := []bson.M{}
-			if err = cursor.All(context.TODO(), &results); err != nil {
-				log.Fatal(err)
+			results := []views.CommunityView{}
+			if err = cursor.All(ctx, &results); err != nil {
+				apierror.WriteError(response, request, err)
+				return
 			}
 
 			if len(results) == 0 {
-				response.WriteHeader(http.StatusNotFound)
-				response.Write([]byte(`{ "message": "Not Found" }`))
+				apierror.Write(response, request, apierror.NotFound)
 				return
 			}
 
-			results[0]["founder"] = formatFounder(results[0]["founder"].(primitive.A)[0].(primitive.M))
-
 			json.NewEncoder(response).Encode(results[0])
 		}
 	}
 }
 
+// Members fetch members of given community
+func Members(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+		params := mux.Vars(request)
+
+		id, err := primitive.ObjectIDFromHex(params["id"])
+		if err != nil {
+			apierror.Write(response, request, apierror.InvalidID)
+			return
+		}
+		page, err := pagination.FromRequest(request, edges.ListLimit, edges.NewestFirst)
+		if err != nil {
+			apierror.Write(response, request, apierror.InvalidPage)
+			return
+		}
+
+		_, _, ok := request.BasicAuth()
+
+		if ok {
+			results, err := edges.Users(request.Context(), db, edges.Membership, edges.Membership.To, id, page)
+			if err != nil {
+				apierror.WriteError(response, request, err)
+				return
+			}
+
+			page.Write(response, results)
+		}
+	}
+}
+
 // CommunityAction is for joining and leaving communities
-func CommunityAction(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func CommunityAction(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 		actionType := mux.Vars(request)["type"]
@@ -198,34 +217,54 @@ func CommunityAction(db *mongo.Client) func(response http.ResponseWriter, reques
 
 			if err == nil {
 				if actionType == "join" {
-					join(db, response, request, oID, action.ID)
+					setMembership(db, response, request, oID, action.ID, true)
 					return
 				} else if actionType == "leave" {
-					leave(db, response, request, oID, action.ID)
+					setMembership(db, response, request, oID, action.ID, false)
 					return
 				}
 			} else {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.WriteError(response, request, err)
 				return
 			}
 
 		}
 
-		response.WriteHeader(http.StatusNotFound)
-		response.Write([]byte(`{ "message": "Not Found" }`))
+		apierror.Write(response, request, apierror.NotFound)
 		return
 	}
 }
 
+// Membership joins given community on PUT and leaves it on DELETE, repeated
+// requests leave the community as it is and respond the same
+func Membership(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+		params := mux.Vars(request)
+
+		id, err := primitive.ObjectIDFromHex(params["id"])
+		if err != nil {
+			apierror.Write(response, request, apierror.InvalidID)
+			return
+		}
+
+		authID, _, ok := request.BasicAuth()
+
+		if ok {
+			oID, _ := primitive.ObjectIDFromHex(authID)
+			setMembership(db, response, request, oID, id, request.Method == http.MethodPut)
+		}
+	}
+}
+
 // GetUsersCommunities is for fetching communities of given user
-func GetUsersCommunities(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func GetUsersCommunities(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 		params := mux.Vars(request)
 
-		collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("communities")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		collection := db.Collection("communities")
+		ctx, cancel := database.Query(request.Context())
 
 		defer cancel()
 
@@ -233,23 +272,28 @@ func GetUsersCommunities(db *mongo.Client) func(response http.ResponseWriter, re
 		oID, _ := primitive.ObjectIDFromHex(authID)
 		ID, err := primitive.ObjectIDFromHex(params["id"])
 		if err != nil {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.Write(response, request, apierror.InvalidID)
 			return
 		}
 
 		if ok {
-			opts := options.Aggregate().SetMaxTime(2 * time.Second)
+			opts := database.Aggregate()
+
+			communityIDs, err := edges.Targets(request.Context(), db, edges.Membership, ID)
+			if err != nil {
+				apierror.WriteError(response, request, err)
+				return
+			}
 
 			match := bson.D{
 				primitive.E{
 					Key: "$match",
 					Value: bson.D{
 						primitive.E{
-							Key: "members",
+							Key: "_id",
 							Value: bson.D{primitive.E{
 								Key:   "$in",
-								Value: []interface{}{ID},
+								Value: communityIDs,
 							}},
 						},
 					},
@@ -263,12 +307,7 @@ func GetUsersCommunities(db *mongo.Client) func(response http.ResponseWriter, re
 						primitive.E{Key: "_id", Value: "$_id"},
 						primitive.E{Key: "title", Value: "$title"},
 						primitive.E{Key: "image", Value: "$image"},
-						primitive.E{Key: "members", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$members"},
-						}},
-						primitive.E{Key: "joined", Value: bson.D{
-							primitive.E{Key: "$in", Value: []interface{}{oID, "$members"}},
-						}},
+						primitive.E{Key: "members", Value: "$memberCount"},
 					},
 				},
 			}
@@ -283,17 +322,20 @@ func GetUsersCommunities(db *mongo.Client) func(response http.ResponseWriter, re
 				},
 			}
 
-			cursor, err := collection.Aggregate(ctx, mongo.Pipeline{match, project, sort}, opts)
+			pipeline := mongo.Pipeline{match, project, sort}
+			pipeline = append(pipeline, edges.Flag(edges.Membership, oID, "joined")...)
+
+			cursor, err := collection.Aggregate(ctx, pipeline, opts)
 
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.WriteError(response, request, err)
 				return
 			}
 
-			results := []bson.M{}
-			if err = cursor.All(context.TODO(), &results); err != nil {
-				log.Fatal(err)
+			results := []views.CommunityView{}
+			if err = cursor.All(ctx, &results); err != nil {
+				apierror.WriteError(response, request, err)
+				return
 			}
 
 			json.NewEncoder(response).Encode(results)
@@ -301,144 +343,49 @@ func GetUsersCommunities(db *mongo.Client) func(response http.ResponseWriter, re
 	}
 }
 
-func join(
-	db *mongo.Client,
+// setMembership brings membership of joinerID in communityID to given state
+// and responds the resulting state of the community
+func setMembership(
+	db *mongo.Database,
 	response http.ResponseWriter,
 	request *http.Request,
 	joinerID primitive.ObjectID,
 	communityID primitive.ObjectID,
-) error {
-	communitiesCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("communities")
-	usersCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	joined bool,
+) {
+	collection := db.Collection("communities")
+	ctx, cancel := database.Query(request.Context())
 
 	defer cancel()
 
-	results := joined(db, response, request, joinerID, communityID)
-
-	if len(results) > 0 {
-		if results[0]["joined"].(bool) {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "Community already joined" }`))
-			return nil
-		}
-		updateOpts := options.FindOneAndUpdate().SetUpsert(true)
-
-		filter := bson.D{primitive.E{Key: "_id", Value: communityID}}
-		update := bson.D{primitive.E{
-			Key: "$push", Value: bson.D{primitive.E{Key: "members", Value: joinerID}},
-		}}
-		communitiesCollection.FindOneAndUpdate(ctx, filter, update, updateOpts)
-
-		filter = bson.D{primitive.E{Key: "_id", Value: joinerID}}
-		update = bson.D{primitive.E{
-			Key: "$push", Value: bson.D{primitive.E{Key: "communities", Value: communityID}},
-		}}
-		usersCollection.FindOneAndUpdate(ctx, filter, update, updateOpts)
-
-		response.Write([]byte(`{ "message": "OK" }`))
-		return nil
+	_, err := edges.Set(request.Context(), db, edges.Membership, joinerID, communityID, joined, edges.Counter{
+		Collection: "communities",
+		ID:         communityID,
+		Field:      "memberCount",
+	})
+	if err == edges.ErrNotFound {
+		apierror.Write(response, request, apierror.CommunityNotFound)
+		return
 	}
-
-	response.WriteHeader(http.StatusNotFound)
-	response.Write([]byte(`{ "message": "Post Not Found" }`))
-	return nil
-}
-
-func leave(
-	db *mongo.Client,
-	response http.ResponseWriter,
-	request *http.Request,
-	joinerID primitive.ObjectID,
-	communityID primitive.ObjectID,
-) error {
-	communitiesCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("communities")
-	usersCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-
-	defer cancel()
-
-	results := joined(db, response, request, joinerID, communityID)
-
-	if len(results) > 0 {
-		if results[0]["joined"].(bool) == false {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "Community already left" }`))
-			return nil
-		}
-		updateOpts := options.FindOneAndUpdate().SetUpsert(true)
-
-		filter := bson.D{primitive.E{Key: "_id", Value: communityID}}
-		update := bson.D{primitive.E{
-			Key: "$pull", Value: bson.D{primitive.E{Key: "members", Value: joinerID}},
-		}}
-		communitiesCollection.FindOneAndUpdate(ctx, filter, update, updateOpts)
-
-		filter = bson.D{primitive.E{Key: "_id", Value: joinerID}}
-		update = bson.D{primitive.E{
-			Key: "$pull", Value: bson.D{primitive.E{Key: "communities", Value: communityID}},
-		}}
-		usersCollection.FindOneAndUpdate(ctx, filter, update, updateOpts)
-
-		response.Write([]byte(`{ "message": "OK" }`))
-		return nil
+	if err != nil {
+		apierror.WriteError(response, request, err)
+		return
 	}
 
-	response.WriteHeader(http.StatusNotFound)
-	response.Write([]byte(`{ "message": "Post Not Found" }`))
-	return nil
-}
-
-func joined(
-	db *mongo.Client,
-	response http.ResponseWriter,
-	request *http.Request,
-	joinerID primitive.ObjectID,
-	communityID primitive.ObjectID,
-) []bson.M {
-	collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-
-	defer cancel()
-
-	aggregateOpts := options.Aggregate().SetMaxTime(2 * time.Second)
-	match := bson.D{
-		primitive.E{Key: "$match", Value: bson.D{primitive.E{Key: "_id", Value: joinerID}}},
-	}
-	project := bson.D{
-		primitive.E{
-			Key: "$project",
-			Value: bson.D{
-				primitive.E{Key: "joined", Value: bson.D{
-					primitive.E{Key: "$in", Value: []interface{}{communityID, "$communities"}},
-				}},
-			},
-		},
+	var community bson.M
+	opts := options.FindOne().SetProjection(bson.D{primitive.E{Key: "memberCount", Value: "$memberCount"}})
+	err = collection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: communityID}}, opts).Decode(&community)
+	if err == mongo.ErrNoDocuments {
+		apierror.Write(response, request, apierror.CommunityNotFound)
+		return
 	}
-	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{match, project}, aggregateOpts)
-
 	if err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
-		response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
-		return nil
-	}
-
-	var results []bson.M
-	if err = cursor.All(ctx, &results); err != nil {
-		log.Fatal(err)
+		apierror.WriteError(response, request, err)
+		return
 	}
 
-	return results
-}
-
-func formatFounder(author primitive.M) primitive.M {
-	result := primitive.M{}
-
-	result["_id"] = author["_id"]
-	result["fullname"] = author["fullname"]
-	result["username"] = author["username"]
-	result["image"] = author["image"]
-	result["verified"] = author["verified"]
-
-	return result
+	json.NewEncoder(response).Encode(bson.M{
+		"joined":  joined,
+		"members": community["memberCount"],
+	})
 }
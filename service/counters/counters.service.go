@@ -0,0 +1,201 @@
+package counters
+
+import (
+	"context"
+	"jt-api/edges"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// batchSize is the number of corrections sent in a single bulk write
+const batchSize = 1000
+
+// Counter is a denormalized count of an ID array or of edges, Array is used
+// when Kind is not set
+type Counter struct {
+	Collection string
+	Field      string
+	Array      string
+	Kind       edges.Kind
+	// Key is the edge field that refers to the counted document
+	Key string
+}
+
+// Counters lists every counter kept in step with its array or edges
+var Counters = []Counter{
+	{Collection: "posts", Field: "upvoteCount", Kind: edges.Vote, Key: edges.Vote.To},
+	{Collection: "posts", Field: "answerCount", Array: "answers"},
+	{Collection: "comments", Field: "upvoteCount", Kind: edges.Vote, Key: edges.Vote.To},
+	{Collection: "comments", Field: "answerCount", Array: "answers"},
+	{Collection: "users", Field: "followerCount", Kind: edges.Follow, Key: edges.Follow.To},
+	{Collection: "users", Field: "followCount", Kind: edges.Follow, Key: edges.Follow.From},
+	{Collection: "communities", Field: "memberCount", Kind: edges.Membership, Key: edges.Membership.To},
+}
+
+// Reconcile recomputes every counter that drifted from its source, returns
+// the number of corrected documents per counter
+func Reconcile(ctx context.Context, db *mongo.Database) (map[Counter]int64, error) {
+	fixed := map[Counter]int64{}
+
+	for _, counter := range Counters {
+		modified, err := reconcile(ctx, db, counter)
+		if err != nil {
+			return fixed, err
+		}
+		fixed[counter] = modified
+	}
+
+	return fixed, nil
+}
+
+func reconcile(ctx context.Context, db *mongo.Database, counter Counter) (int64, error) {
+	if counter.Kind.Collection == "" {
+		return reconcileArray(ctx, db, counter)
+	}
+	return reconcileEdges(ctx, db, counter)
+}
+
+func reconcileArray(ctx context.Context, db *mongo.Database, counter Counter) (int64, error) {
+	collection := db.Collection(counter.Collection)
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+
+	defer cancel()
+
+	size := bson.D{primitive.E{Key: "$size", Value: bson.D{
+		primitive.E{Key: "$ifNull", Value: []interface{}{"$" + counter.Array, []interface{}{}}},
+	}}}
+
+	filter := bson.D{primitive.E{Key: "$expr", Value: bson.D{
+		primitive.E{Key: "$ne", Value: []interface{}{"$" + counter.Field, size}},
+	}}}
+	update := mongo.Pipeline{
+		bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: counter.Field, Value: size}}}},
+	}
+
+	result, err := collection.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.ModifiedCount, nil
+}
+
+func reconcileEdges(ctx context.Context, db *mongo.Database, counter Counter) (int64, error) {
+	collection := db.Collection(counter.Collection)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Minute)
+
+	defer cancel()
+
+	// Edges are counted inside the lookup, copying them out would exceed the
+	// document size limit for documents with millions of edges
+	lookup := bson.D{
+		primitive.E{
+			Key: "$lookup",
+			Value: bson.D{
+				primitive.E{Key: "from", Value: counter.Kind.Collection},
+				primitive.E{Key: "localField", Value: "_id"},
+				primitive.E{Key: "foreignField", Value: counter.Key},
+				primitive.E{Key: "pipeline", Value: mongo.Pipeline{
+					bson.D{primitive.E{Key: "$count", Value: "n"}},
+				}},
+				primitive.E{Key: "as", Value: "edges"},
+			},
+		},
+	}
+
+	project := bson.D{
+		primitive.E{
+			Key: "$project",
+			Value: bson.D{
+				primitive.E{Key: "current", Value: "$" + counter.Field},
+				primitive.E{Key: "count", Value: bson.D{primitive.E{Key: "$ifNull", Value: []interface{}{
+					bson.D{primitive.E{Key: "$first", Value: "$edges.n"}},
+					0,
+				}}}},
+			},
+		},
+	}
+
+	drifted := bson.D{
+		primitive.E{Key: "$match", Value: bson.D{primitive.E{Key: "$expr", Value: bson.D{
+			primitive.E{Key: "$ne", Value: []interface{}{"$current", "$count"}},
+		}}}},
+	}
+
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{lookup, project, drifted})
+	if err != nil {
+		return 0, err
+	}
+
+	defer cursor.Close(ctx)
+
+	var modified int64
+	models := []mongo.WriteModel{}
+
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		result, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if err != nil {
+			return err
+		}
+		modified += result.ModifiedCount
+		models = models[:0]
+		return nil
+	}
+
+	for cursor.Next(ctx) {
+		var document struct {
+			ID    primitive.ObjectID `bson:"_id"`
+			Count int                `bson:"count"`
+		}
+		if err = cursor.Decode(&document); err != nil {
+			return modified, err
+		}
+
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.D{primitive.E{Key: "_id", Value: document.ID}}).
+			SetUpdate(bson.D{primitive.E{Key: "$set", Value: bson.D{
+				primitive.E{Key: counter.Field, Value: document.Count},
+			}}}))
+
+		if len(models) == batchSize {
+			if err = flush(); err != nil {
+				return modified, err
+			}
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return modified, err
+	}
+
+	err = flush()
+	return modified, err
+}
+
+// CreateIndexes creates indexes for sorting by user and community counters,
+// post counters are indexed with post listings
+func CreateIndexes(db *mongo.Database) error {
+	usersCollection := db.Collection("users")
+	communitiesCollection := db.Collection("communities")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	_, err := usersCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{primitive.E{Key: "followerCount", Value: -1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = communitiesCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{primitive.E{Key: "memberCount", Value: -1}},
+	})
+	return err
+}
@@ -1,8 +1,11 @@
 package embed
 
 import (
+	"bytes"
 	"io/ioutil"
+	"jt-api/apierror"
 	"jt-api/service/posts"
+	"jt-api/views"
 	"net/http"
 	"os"
 	"path"
@@ -15,56 +18,65 @@ import (
 
 // PostEmbed struct for html templating
 type PostEmbed struct {
-	Post   primitive.M
+	Post   *views.PostView
+	Date   string
 	Width  string
 	Height string
 	Theme  string
 }
 
 // Post returns an html post embed for websites
-func Post(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func Post(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "text/html; charset=utf-8")
 
 		params := mux.Vars(request)
 		id, err := primitive.ObjectIDFromHex(params["id"])
+		if err != nil {
+			apierror.Write(response, request, apierror.InvalidID)
+			return
+		}
 
-		post, err := posts.AnonymousPost(db, id)
+		post, err := posts.AnonymousPost(request.Context(), db, id)
 		if err != nil {
-			response.WriteHeader(http.StatusInternalServerError)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.WriteError(response, request, err)
 			return
 		}
 
 		dir, err := os.Getwd()
 		if err != nil {
-			response.WriteHeader(http.StatusInternalServerError)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.WriteError(response, request, err)
 			return
 		}
 
 		data, err := ioutil.ReadFile(path.Join(dir, "service/embed/post.html"))
 		if err != nil {
-			response.WriteHeader(http.StatusInternalServerError)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.WriteError(response, request, err)
 			return
 		}
 
 		tmpl, err := template.New("test").Parse(string(data))
 		if err != nil {
-			panic(err)
+			apierror.WriteError(response, request, err)
+			return
 		}
 
-		date := post["date"].(primitive.DateTime).Time()
-		post["date"] = date.Format("02-Jan-2006")
-
 		embed := PostEmbed{
 			Post:   post,
+			Date:   post.Date.Time().Format("02-Jan-2006"),
 			Width:  params["width"],
 			Height: params["height"],
 			Theme:  params["theme"],
 		}
 
-		tmpl.Execute(response, embed)
+		// Render to a buffer first so a failing template results in an error
+		// response instead of a half written page
+		var page bytes.Buffer
+		if err = tmpl.Execute(&page, embed); err != nil {
+			apierror.WriteError(response, request, err)
+			return
+		}
+
+		page.WriteTo(response)
 	}
 }
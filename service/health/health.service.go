@@ -0,0 +1,162 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"jt-api/config"
+	"jt-api/logger"
+	"jt-api/service/notification"
+	"jt-api/service/upload"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Build info, set at build time with
+// -ldflags "-X jt-api/service/health.Commit=<sha> -X jt-api/service/health.BuildTime=<time>"
+var (
+	Commit    = "unknown"
+	BuildTime = "unknown"
+)
+
+// checkTimeout bounds every readiness check
+const checkTimeout = 2 * time.Second
+
+// External services are not checked on every probe, their last result is
+// reused for externalCheckInterval
+const externalCheckInterval = 30 * time.Second
+
+// draining is set once shutdown starts so readiness fails while in-flight
+// requests finish
+var draining int32
+
+// Drain makes readiness fail from now on
+func Drain() {
+	atomic.StoreInt32(&draining, 1)
+}
+
+// Statuses of readiness checks, errors are only logged so probes do not leak
+// details of the infrastructure
+const (
+	statusOK          = "ok"
+	statusDegraded    = "degraded"
+	statusUnavailable = "unavailable"
+	statusDraining    = "draining"
+)
+
+// ReadyResponse is the response model of readiness checks
+type ReadyResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// VersionResponse is the response model of build info
+type VersionResponse struct {
+	Commit      string `json:"commit"`
+	BuildTime   string `json:"buildTime"`
+	Fingerprint string `json:"configFingerprint"`
+}
+
+// cachedCheck runs check at most once per externalCheckInterval, a failure
+// is logged when it is checked rather than on every probe
+type cachedCheck struct {
+	name  string
+	check func(ctx context.Context) error
+
+	mutex   sync.Mutex
+	checked time.Time
+	err     error
+}
+
+func (cached *cachedCheck) run() error {
+	cached.mutex.Lock()
+	defer cached.mutex.Unlock()
+
+	if time.Since(cached.checked) < externalCheckInterval {
+		return cached.err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+
+	defer cancel()
+
+	cached.err = cached.check(ctx)
+	cached.checked = time.Now()
+	if cached.err != nil {
+		slog.Warn("Readiness check failed", "check", cached.name, "error", cached.err)
+	}
+	return cached.err
+}
+
+// Live tells the process is up
+func Live() func(response http.ResponseWriter, request *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+		response.Write([]byte(`{ "status": "ok" }`))
+	}
+}
+
+// Ready tells if the server can serve requests, the database must be
+// reachable and shutdown must not have started
+//
+// The notifier and the image storage only serve some requests, the server is
+// degraded but still ready while they are unreachable
+func Ready(db *mongo.Database, conf config.Server) func(response http.ResponseWriter, request *http.Request) {
+	notifier := &cachedCheck{name: "notifier", check: notification.Check}
+	storage := &cachedCheck{name: "storage", check: func(ctx context.Context) error {
+		return upload.Check(ctx, conf)
+	}}
+
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+
+		ctx, cancel := context.WithTimeout(request.Context(), checkTimeout)
+
+		defer cancel()
+
+		result := ReadyResponse{Status: statusOK, Checks: map[string]string{"mongo": statusOK}}
+
+		if err := db.Client().Ping(ctx, nil); err != nil {
+			logger.FromRequest(request).Error("Readiness check failed", "check", "mongo", "error", err)
+			result.Checks["mongo"] = statusUnavailable
+			result.Status = statusUnavailable
+		}
+
+		for _, cached := range []*cachedCheck{notifier, storage} {
+			result.Checks[cached.name] = statusOK
+			if cached.run() != nil {
+				result.Checks[cached.name] = statusDegraded
+				if result.Status == statusOK {
+					result.Status = statusDegraded
+				}
+			}
+		}
+
+		if atomic.LoadInt32(&draining) == 1 {
+			result.Status = statusDraining
+		}
+
+		if result.Status == statusUnavailable || result.Status == statusDraining {
+			response.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(response).Encode(result)
+	}
+}
+
+// Version responds build info and the configuration fingerprint
+func Version(conf config.Server) func(response http.ResponseWriter, request *http.Request) {
+	fingerprint := conf.Fingerprint()
+
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+		json.NewEncoder(response).Encode(VersionResponse{
+			Commit:      Commit,
+			BuildTime:   BuildTime,
+			Fingerprint: fingerprint,
+		})
+	}
+}
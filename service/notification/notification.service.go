@@ -3,10 +3,16 @@ package notification
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"log"
+	"errors"
+	"jt-api/apierror"
+	"jt-api/config"
+	"jt-api/database"
+	"jt-api/logger"
+	"jt-api/metrics"
+	"jt-api/tracing"
+	"log/slog"
 	"net/http"
-	"os"
+	"strings"
 	"time"
 
 	firebase "firebase.google.com/go"
@@ -15,7 +21,6 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"google.golang.org/api/option"
 )
 
@@ -32,19 +37,34 @@ type Notification struct {
 var app *firebase.App
 
 // InitFirebase initializes the firebase admin
-func InitFirebase() {
-	opt := option.WithCredentialsFile("./firebase-service-account-key.json")
+func InitFirebase(conf config.Server) {
+	opt := option.WithCredentialsFile(conf.FirebaseCredentials)
 	var err error
 	app, err = firebase.NewApp(context.Background(), nil, opt)
 	if err != nil {
-		fmt.Println("Failed to initialize firebase")
-		log.Fatal(err)
+		logger.Fatal("Failed to initialize firebase", err)
 	}
-	fmt.Println("Initialized firebase admin")
+	slog.Info("Initialized firebase admin")
+}
+
+// Check tells if firebase is initialized and reachable by validating a
+// message without delivering it
+func Check(ctx context.Context) error {
+	if app == nil {
+		return errors.New("Firebase is not initialized")
+	}
+
+	client, err := app.Messaging(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.SendDryRun(ctx, &messaging.Message{Topic: "readiness"})
+	return err
 }
 
 // GetNotifications fetch personal notifications from database
-func GetNotifications(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func GetNotifications(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 
@@ -52,8 +72,8 @@ func GetNotifications(db *mongo.Client) func(response http.ResponseWriter, reque
 
 		if ok {
 			oID, _ := primitive.ObjectIDFromHex(authID)
-			collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			collection := db.Collection("users")
+			ctx, cancel := database.Query(request.Context())
 
 			defer cancel()
 
@@ -111,23 +131,22 @@ func GetNotifications(db *mongo.Client) func(response http.ResponseWriter, reque
 				},
 			}
 
-			opts := options.Aggregate().SetMaxTime(2 * time.Second)
+			opts := database.Aggregate()
 
 			cursor, err := collection.Aggregate(ctx, mongo.Pipeline{match, project, unwind, sort, group}, opts)
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.WriteError(response, request, err)
 				return
 			}
 
 			results := []bson.M{}
-			if err = cursor.All(context.TODO(), &results); err != nil {
-				log.Fatal(err)
+			if err = cursor.All(ctx, &results); err != nil {
+				apierror.WriteError(response, request, err)
+				return
 			}
 
 			if len(results) == 0 {
-				response.WriteHeader(http.StatusNotFound)
-				response.Write([]byte(`{ "message": "Not Found" }`))
+				apierror.Write(response, request, apierror.NotFound)
 				return
 			}
 
@@ -137,32 +156,35 @@ func GetNotifications(db *mongo.Client) func(response http.ResponseWriter, reque
 }
 
 // SendToUsername sends a notification to given user
-func SendToUsername(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func SendToUsername(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 
 		params := mux.Vars(request)
-		ctx := context.Background()
-		client, err := app.Messaging(ctx)
+		client, err := app.Messaging(request.Context())
 		if err != nil {
-			response.WriteHeader(http.StatusInternalServerError)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.WriteError(response, request, err)
 			return
 		}
 
-		collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		collection := db.Collection("users")
+		ctx, cancel := database.Query(request.Context())
 
 		defer cancel()
 
 		var user bson.M
-		err = collection.FindOne(ctx, bson.D{
-			primitive.E{Key: "username", Value: params["username"]},
-		}).Decode(&user)
+		// Same as users.UsernameFilter, which can not be imported here since
+		// users sends notifications
+		err = collection.FindOne(ctx, bson.D{primitive.E{Key: "$or", Value: []interface{}{
+			bson.D{primitive.E{Key: "usernameLower", Value: strings.ToLower(strings.TrimSpace(params["username"]))}},
+			bson.D{
+				primitive.E{Key: "usernameLower", Value: bson.D{primitive.E{Key: "$exists", Value: false}}},
+				primitive.E{Key: "username", Value: params["username"]},
+			},
+		}}}).Decode(&user)
 
 		if err != nil {
-			response.WriteHeader(http.StatusInternalServerError)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.WriteError(response, request, err)
 			return
 		}
 
@@ -170,14 +192,12 @@ func SendToUsername(db *mongo.Client) func(response http.ResponseWriter, request
 		err = json.NewDecoder(request.Body).Decode(&notification)
 
 		if err != nil {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.Write(response, request, apierror.InvalidBody)
 			return
 		}
 
 		if notification.Title == "" || notification.Body == "" {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "Missing Parameters" }`))
+			apierror.Write(response, request, apierror.MissingFields)
 			return
 		}
 
@@ -193,39 +213,37 @@ func SendToUsername(db *mongo.Client) func(response http.ResponseWriter, request
 			Token: user["FCMToken"].(string),
 		}
 
-		result, err := client.Send(ctx, message)
+		result, err := send(ctx, client, message)
 		if err != nil {
-			response.WriteHeader(http.StatusInternalServerError)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.WriteError(response, request, err)
 			return
 		}
 
-		response.Write([]byte(`{ "message": "` + result + `" }`))
+		json.NewEncoder(response).Encode(map[string]string{"message": result})
 	}
 }
 
 // SendToID sends a notification to given user
-func SendToID(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func SendToID(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 
 		params := mux.Vars(request)
-		fmt.Println(app, params["id"])
+		logger.FromRequest(request).Debug("Sending to an ID is not implemented", "id", params["id"])
 
 		json.NewEncoder(response).Encode([]int{})
 	}
 }
 
 // SendNotification a service for sending notifications by server itself
-func SendNotification(id primitive.ObjectID, notification messaging.Notification, db *mongo.Client) error {
-	ctx := context.Background()
+func SendNotification(ctx context.Context, id primitive.ObjectID, notification messaging.Notification, db *mongo.Database) error {
 	client, err := app.Messaging(ctx)
 	if err != nil {
 		return err
 	}
 
-	collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := db.Collection("users")
+	ctx, cancel := database.Query(ctx)
 
 	defer cancel()
 
@@ -250,7 +268,7 @@ func SendNotification(id primitive.ObjectID, notification messaging.Notification
 		Token: user["FCMToken"].(string),
 	}
 
-	_, err = client.Send(ctx, message)
+	_, err = send(ctx, client, message)
 	if err != nil {
 		return err
 	}
@@ -274,3 +292,13 @@ func SendNotification(id primitive.ObjectID, notification messaging.Notification
 
 	return nil
 }
+
+// send sends message through firebase cloud messaging, traced and counted
+func send(ctx context.Context, client *messaging.Client, message *messaging.Message) (string, error) {
+	ctx, span := tracing.Start(ctx, "fcm.send")
+	result, err := client.Send(ctx, message)
+	tracing.End(span, err)
+	metrics.Notification(err)
+
+	return result, err
+}
@@ -3,13 +3,19 @@ package posts
 import (
 	"context"
 	"encoding/json"
-	"errors"
+	"jt-api/apierror"
+	"jt-api/background"
 	"jt-api/config"
+	"jt-api/database"
+	"jt-api/edges"
+	"jt-api/logger"
+	"jt-api/pagination"
 	"jt-api/service/notification"
-	"log"
+	"jt-api/service/tags"
+	"jt-api/service/timeline"
+	"jt-api/validation"
+	"jt-api/views"
 	"net/http"
-	"os"
-	"strconv"
 	"time"
 
 	"firebase.google.com/go/messaging"
@@ -23,24 +29,39 @@ import (
 // Post is Common post model for database
 type Post struct {
 	ID        primitive.ObjectID    `json:"_id,omitempty" bson:"_id,omitempty"`
-	Title     string                `json:"title" bson:"title"`
-	Content   *[]interface{}        `json:"content" bson:"content"`
+	Title     string                `json:"title" bson:"title" validate:"required,max=300"`
+	Content   *[]interface{}        `json:"content" bson:"content" validate:"max=100"`
 	Date      primitive.DateTime    `json:"date,omitempty" bson:"date,omitempty"`
 	Author    primitive.ObjectID    `json:"author,omitempty" bson:"author,omitempty"`
 	Community primitive.ObjectID    `json:"community,omitempty" bson:"community,omitempty"`
-	Images    *[]string             `json:"images" bson:"images"`
-	Tags      *[]string             `json:"tags" bson:"tags"`
-	Upvotes   *[]primitive.ObjectID `json:"upvotes" bson:"upvotes"`
+	Images    *[]string             `json:"images" bson:"images" validate:"max=4"`
+	Tags      *[]string             `json:"tags" bson:"tags" validate:"max=5"`
 	Answers   *[]primitive.ObjectID `json:"answers" bson:"answers"`
+	Hot       float64               `json:"hot" bson:"hot"`
+	Rising    float64               `json:"rising" bson:"rising"`
+
+	// Counters are kept in step with upvotes and answers so listings do not
+	// need to compute array sizes
+	UpvoteCount int `json:"upvoteCount" bson:"upvoteCount"`
+	AnswerCount int `json:"answerCount" bson:"answerCount"`
 }
 
+// Sort orders of post listings
+var (
+	newestFirst = []pagination.SortField{{Key: "date", Order: -1, Kind: pagination.Date}}
+	mostUpvoted = []pagination.SortField{
+		{Key: "upvotes", Order: -1, Kind: pagination.Number, Field: "upvoteCount"},
+		{Key: "date", Order: -1, Kind: pagination.Date},
+	}
+)
+
 // PostActionModel is model for upvoting and downvoting actions
 type PostActionModel struct {
 	ID primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
 }
 
 // CreatePost creates post and registeres to the database
-func CreatePost(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func CreatePost(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 
@@ -49,34 +70,57 @@ func CreatePost(db *mongo.Client) func(response http.ResponseWriter, request *ht
 		communityID, _ := primitive.ObjectIDFromHex("60049bc9888d8b3284e5cb4f")
 
 		if ok {
-			collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("posts")
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			collection := db.Collection("posts")
+			ctx, cancel := database.Query(request.Context())
 
 			defer cancel()
 
 			var post Post
-			json.NewDecoder(request.Body).Decode(&post)
+			if err := json.NewDecoder(request.Body).Decode(&post); err != nil {
+				apierror.Write(response, request, apierror.InvalidBody)
+				return
+			}
+			if err := validation.Struct(post); err != nil {
+				apierror.WriteError(response, request, err)
+				return
+			}
 
 			if post.Tags == nil {
 				post.Tags = &[]string{}
 			}
+			normalizedTags := tags.NormalizeAll(*post.Tags)
+			post.Tags = &normalizedTags
 			if post.Images == nil {
 				post.Images = &[]string{}
 			}
 
-			post.Upvotes = &[]primitive.ObjectID{}
 			post.Answers = &[]primitive.ObjectID{}
+			post.UpvoteCount = 0
+			post.AnswerCount = 0
 			post.Date = primitive.NewDateTimeFromTime(time.Now())
+			post.Hot = initialHotScore
+			post.Rising = 0
 			post.Author = oID
 			post.Community = communityID
 
 			result, err := collection.InsertOne(ctx, post)
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.WriteError(response, request, err)
 				return
 			}
 
+			if err = tags.RecordUsage(context.WithoutCancel(ctx), db, *post.Tags); err != nil {
+				logger.FromRequest(request).Error("Failed to record tag usage", "error", err)
+			}
+
+			postID := result.InsertedID.(primitive.ObjectID)
+			log := logger.FromRequest(request)
+			background.Go(func() {
+				if err := timeline.FanOut(context.WithoutCancel(ctx), db, postID, post.Author, post.Date); err != nil {
+					log.Error("Failed to fan out post", "error", err)
+				}
+			})
+
 			json.NewEncoder(response).Encode(result)
 		}
 
@@ -84,7 +128,7 @@ func CreatePost(db *mongo.Client) func(response http.ResponseWriter, request *ht
 }
 
 // GetPost fetch single post from database
-func GetPost(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func GetPost(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 
@@ -93,116 +137,46 @@ func GetPost(db *mongo.Client) func(response http.ResponseWriter, request *http.
 
 		id, err := primitive.ObjectIDFromHex(params["id"])
 		if err != nil {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.Write(response, request, apierror.InvalidID)
 			return
 		}
 
 		if ok {
-			collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("posts")
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-
-			defer cancel()
-
 			oID, _ := primitive.ObjectIDFromHex(authID)
 
-			match := bson.D{
-				primitive.E{
-					Key: "$match",
-					Value: bson.D{
-						primitive.E{Key: "_id", Value: id},
-					},
-				},
-			}
-
-			project := bson.D{
-				primitive.E{
-					Key: "$project",
-					Value: bson.D{
-						primitive.E{Key: "_id", Value: "$_id"},
-						primitive.E{Key: "community", Value: "$community"},
-						primitive.E{Key: "images", Value: "$images"},
-						primitive.E{Key: "tags", Value: "$tags"},
-						primitive.E{Key: "title", Value: "$title"},
-						primitive.E{Key: "content", Value: "$content"},
-						primitive.E{Key: "date", Value: "$date"},
-						primitive.E{Key: "author", Value: "$author"},
-						primitive.E{Key: "upvoted", Value: bson.D{
-							primitive.E{Key: "$in", Value: []interface{}{oID, "$upvotes"}},
-						}},
-						primitive.E{Key: "answers", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$answers"},
-						}},
-						primitive.E{Key: "upvotes", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$upvotes"},
-						}},
-					},
-				},
-			}
-
-			lookupAuthor := bson.D{
-				primitive.E{
-					Key: "$lookup",
-					Value: bson.M{
-						"from":         "users",
-						"localField":   "author",
-						"foreignField": "_id",
-						"as":           "author",
-					},
-				},
-			}
-
-			opts := options.Aggregate().SetMaxTime(2 * time.Second)
-
-			cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
-				match,
-				project,
-				lookupAuthor,
-			}, opts)
-
+			results, err := newPostQuery(bson.D{primitive.E{Key: "_id", Value: id}}).
+				withViewer(oID).
+				find(request.Context(), db)
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.WriteError(response, request, err)
 				return
 			}
 
-			results := []bson.M{}
-			if err = cursor.All(context.TODO(), &results); err != nil {
-				log.Fatal(err)
-			}
-
 			if len(results) == 0 {
-				response.WriteHeader(http.StatusNotFound)
-				response.Write([]byte(`{ "message": "Not Found" }`))
+				apierror.Write(response, request, apierror.PostNotFound)
 				return
 			}
 
-			results[0]["author"] = formatAuthor(results[0]["author"].(primitive.A)[0].(primitive.M))
-
 			json.NewEncoder(response).Encode(results[0])
 		}
 	}
 }
 
 // GetPersonal fetch personal posts from database
-func GetPersonal(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func GetPersonal(db *mongo.Database, conf config.Server) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 
-		params := mux.Vars(request)
-		page, err := strconv.Atoi(params["page"])
+		page, err := pagination.FromRequest(request, conf.PostLimit, newestFirst)
 		if err != nil {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.Write(response, request, apierror.InvalidPage)
 			return
 		}
-		postLimit, _ := strconv.Atoi(os.Getenv("POST_LIMIT"))
 		authID, _, ok := request.BasicAuth()
 
 		if ok {
-			usersCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-			postsCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("posts")
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			usersCollection := db.Collection("users")
+			ctx, cancel := database.Query(request.Context())
 
 			defer cancel()
 
@@ -210,741 +184,275 @@ func GetPersonal(db *mongo.Client) func(response http.ResponseWriter, request *h
 			oID, _ := primitive.ObjectIDFromHex(authID)
 
 			var user bson.M
-			userOptions := options.FindOne().SetProjection(bson.D{primitive.E{Key: "follows", Value: "$follows"}})
+			userOptions := options.FindOne().SetProjection(bson.D{
+				primitive.E{Key: "tags", Value: "$tags"},
+				primitive.E{Key: "timelineReady", Value: "$timelineReady"},
+			})
 			err := usersCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: oID}}, userOptions).Decode(&user)
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.WriteError(response, request, err)
 				return
 			}
 
-			authors := make([]interface{}, len(user["follows"].(primitive.A))+1)
-			for i, v := range user["follows"].(primitive.A) {
-				authors[i] = v
-			}
-			authors = append(authors, "$author")
-
-			match := bson.D{
-				primitive.E{
-					Key: "$match",
-					Value: bson.D{
-						primitive.E{Key: "community", Value: communityID},
-						primitive.E{Key: "author", Value: bson.D{primitive.E{
-							Key:   "$in",
-							Value: authors,
-						}}},
-					},
-				},
+			// Timelines that predate fan-out are rebuilt in the background,
+			// meanwhile the feed is served from what is already there
+			if ready, _ := user["timelineReady"].(bool); !ready {
+				log := logger.FromRequest(request)
+				background.Go(func() {
+					if err := timeline.Rebuild(context.WithoutCancel(ctx), db, oID); err != nil {
+						log.Error("Failed to rebuild timeline", "error", err)
+					}
+				})
 			}
 
-			project := bson.D{
-				primitive.E{
-					Key: "$project",
-					Value: bson.D{
-						primitive.E{Key: "_id", Value: "$_id"},
-						primitive.E{Key: "community", Value: "$community"},
-						primitive.E{Key: "images", Value: "$images"},
-						primitive.E{Key: "tags", Value: "$tags"},
-						primitive.E{Key: "title", Value: "$title"},
-						primitive.E{Key: "content", Value: "$content"},
-						primitive.E{Key: "date", Value: "$date"},
-						primitive.E{Key: "author", Value: "$author"},
-						primitive.E{Key: "upvoted", Value: bson.D{
-							primitive.E{Key: "$in", Value: []interface{}{oID, "$upvotes"}},
-						}},
-						primitive.E{Key: "answers", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$answers"},
-						}},
-						primitive.E{Key: "upvotes", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$upvotes"},
-						}},
-					},
-				},
+			timelinePosts, err := timeline.PostIDs(request.Context(), db, oID, page)
+			if err != nil {
+				apierror.WriteError(response, request, err)
+				return
 			}
 
-			lookupAuthor := bson.D{
-				primitive.E{
-					Key: "$lookup",
-					Value: bson.M{
-						"from":         "users",
-						"localField":   "author",
-						"foreignField": "_id",
-						"as":           "author",
-					},
-				},
+			popularAuthors, err := timeline.PopularFollowees(request.Context(), db, oID)
+			if err != nil {
+				apierror.WriteError(response, request, err)
+				return
 			}
 
-			lookupCommunity := bson.D{
-				primitive.E{
-					Key: "$lookup",
-					Value: bson.M{
-						"from":         "communities",
-						"localField":   "community",
-						"foreignField": "_id",
-						"as":           "community",
-					},
-				},
+			// Posts coming from more than one source are returned once since
+			// they are selected by a single $or
+			sources := []interface{}{
+				bson.D{primitive.E{Key: "_id", Value: bson.D{primitive.E{
+					Key:   "$in",
+					Value: timelinePosts,
+				}}}},
 			}
-
-			sort := bson.D{
-				primitive.E{
-					Key: "$sort",
-					Value: bson.D{primitive.E{
-						Key:   "date",
-						Value: -1,
-					}},
-				},
+			if len(popularAuthors) > 0 {
+				sources = append(sources, bson.D{primitive.E{Key: "author", Value: bson.D{primitive.E{
+					Key:   "$in",
+					Value: popularAuthors,
+				}}}})
 			}
-
-			skip := bson.D{
-				primitive.E{
-					Key:   "$skip",
-					Value: (page - 1) * postLimit,
-				},
+			if followedTags, ok := user["tags"].(primitive.A); ok && len(followedTags) > 0 {
+				sources = append(sources, bson.D{primitive.E{Key: "tags", Value: bson.D{primitive.E{
+					Key:   "$in",
+					Value: followedTags,
+				}}}})
 			}
 
-			limit := bson.D{
-				primitive.E{
-					Key:   "$limit",
-					Value: postLimit,
-				},
+			filter := bson.D{
+				primitive.E{Key: "community", Value: communityID},
+				primitive.E{Key: "$or", Value: sources},
 			}
 
-			opts := options.Aggregate().SetMaxTime(2 * time.Second)
-
-			cursor, err := postsCollection.Aggregate(ctx, mongo.Pipeline{
-				match,
-				project,
-				lookupAuthor,
-				lookupCommunity,
-				sort,
-				skip,
-				limit,
-			}, opts)
-
+			results, err := newPostQuery(filter).
+				withPage(page).
+				withViewer(oID).
+				find(request.Context(), db)
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.WriteError(response, request, err)
 				return
 			}
 
-			results := []bson.M{}
-			if err = cursor.All(context.TODO(), &results); err != nil {
-				log.Fatal(err)
-			}
-
-			mapped := make([]bson.M, len(results))
-			for i, v := range results {
-				v["author"] = formatAuthor(v["author"].(primitive.A)[0].(primitive.M))
-				v["community"] = formatCommunity(v["community"].(primitive.A)[0].(primitive.M))
-				mapped[i] = v
-			}
-
-			json.NewEncoder(response).Encode(mapped)
+			page.Write(response, results)
 		}
 	}
 }
 
 // GetNew fetch personal posts from database
-func GetNew(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func GetNew(db *mongo.Database, conf config.Server) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 
-		params := mux.Vars(request)
-		page, err := strconv.Atoi(params["page"])
+		page, err := pagination.FromRequest(request, conf.PostLimit, newestFirst)
 		if err != nil {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.Write(response, request, apierror.InvalidPage)
 			return
 		}
-		postLimit, _ := strconv.Atoi(os.Getenv("POST_LIMIT"))
 		authID, _, ok := request.BasicAuth()
 
 		if ok {
-			collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("posts")
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-
-			defer cancel()
-
 			communityID, _ := primitive.ObjectIDFromHex("60049bc9888d8b3284e5cb4f")
 			oID, _ := primitive.ObjectIDFromHex(authID)
 
-			match := bson.D{
-				primitive.E{
-					Key: "$match",
-					Value: bson.D{
-						primitive.E{Key: "community", Value: communityID},
-					},
-				},
-			}
-
-			project := bson.D{
-				primitive.E{
-					Key: "$project",
-					Value: bson.D{
-						primitive.E{Key: "_id", Value: "$_id"},
-						primitive.E{Key: "community", Value: "$community"},
-						primitive.E{Key: "images", Value: "$images"},
-						primitive.E{Key: "tags", Value: "$tags"},
-						primitive.E{Key: "title", Value: "$title"},
-						primitive.E{Key: "content", Value: "$content"},
-						primitive.E{Key: "date", Value: "$date"},
-						primitive.E{Key: "author", Value: "$author"},
-						primitive.E{Key: "upvoted", Value: bson.D{
-							primitive.E{Key: "$in", Value: []interface{}{oID, "$upvotes"}},
-						}},
-						primitive.E{Key: "answers", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$answers"},
-						}},
-						primitive.E{Key: "upvotes", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$upvotes"},
-						}},
-					},
-				},
-			}
-
-			lookupAuthor := bson.D{
-				primitive.E{
-					Key: "$lookup",
-					Value: bson.M{
-						"from":         "users",
-						"localField":   "author",
-						"foreignField": "_id",
-						"as":           "author",
-					},
-				},
-			}
-
-			lookupCommunity := bson.D{
-				primitive.E{
-					Key: "$lookup",
-					Value: bson.M{
-						"from":         "communities",
-						"localField":   "community",
-						"foreignField": "_id",
-						"as":           "community",
-					},
-				},
-			}
-
-			sort := bson.D{
-				primitive.E{
-					Key: "$sort",
-					Value: bson.D{primitive.E{
-						Key:   "date",
-						Value: -1,
-					}},
-				},
-			}
-
-			skip := bson.D{
-				primitive.E{
-					Key:   "$skip",
-					Value: (page - 1) * postLimit,
-				},
-			}
-
-			limit := bson.D{
-				primitive.E{
-					Key:   "$limit",
-					Value: postLimit,
-				},
-			}
-
-			opts := options.Aggregate().SetMaxTime(2 * time.Second)
-
-			cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
-				match,
-				project,
-				lookupAuthor,
-				lookupCommunity,
-				sort,
-				skip,
-				limit,
-			}, opts)
-
+			results, err := newPostQuery(bson.D{primitive.E{Key: "community", Value: communityID}}).
+				withPage(page).
+				withViewer(oID).
+				find(request.Context(), db)
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.WriteError(response, request, err)
 				return
 			}
 
-			results := []bson.M{}
-			if err = cursor.All(context.TODO(), &results); err != nil {
-				log.Fatal(err)
-			}
-
-			mapped := make([]bson.M, len(results))
-			for i, v := range results {
-				v["author"] = formatAuthor(v["author"].(primitive.A)[0].(primitive.M))
-				v["community"] = formatCommunity(v["community"].(primitive.A)[0].(primitive.M))
-				mapped[i] = v
-			}
-
-			json.NewEncoder(response).Encode(mapped)
+			page.Write(response, results)
 		}
 	}
 }
 
 // GetLiked fetch personal posts from database
-func GetLiked(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func GetLiked(db *mongo.Database, conf config.Server) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 
-		params := mux.Vars(request)
-		page, err := strconv.Atoi(params["page"])
+		rank, err := rankingFromRequest(request, "top")
+		if err != nil {
+			apierror.Write(response, request, apierror.InvalidSort)
+			return
+		}
+		page, err := pagination.FromRequest(request, conf.PostLimit, rank.sort)
 		if err != nil {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.Write(response, request, apierror.InvalidPage)
 			return
 		}
-		postLimit, _ := strconv.Atoi(os.Getenv("POST_LIMIT"))
 		authID, _, ok := request.BasicAuth()
 
 		if ok {
-			collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("posts")
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-
-			defer cancel()
-
 			communityID, _ := primitive.ObjectIDFromHex("60049bc9888d8b3284e5cb4f")
 			oID, _ := primitive.ObjectIDFromHex(authID)
 
-			match := bson.D{
-				primitive.E{
-					Key: "$match",
-					Value: bson.D{
-						primitive.E{Key: "community", Value: communityID},
-					},
-				},
-			}
-
-			project := bson.D{
-				primitive.E{
-					Key: "$project",
-					Value: bson.D{
-						primitive.E{Key: "_id", Value: "$_id"},
-						primitive.E{Key: "community", Value: "$community"},
-						primitive.E{Key: "images", Value: "$images"},
-						primitive.E{Key: "tags", Value: "$tags"},
-						primitive.E{Key: "title", Value: "$title"},
-						primitive.E{Key: "content", Value: "$content"},
-						primitive.E{Key: "date", Value: "$date"},
-						primitive.E{Key: "author", Value: "$author"},
-						primitive.E{Key: "upvoted", Value: bson.D{
-							primitive.E{Key: "$in", Value: []interface{}{oID, "$upvotes"}},
-						}},
-						primitive.E{Key: "answers", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$answers"},
-						}},
-						primitive.E{Key: "upvotes", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$upvotes"},
-						}},
-					},
-				},
-			}
-
-			lookupAuthor := bson.D{
-				primitive.E{
-					Key: "$lookup",
-					Value: bson.M{
-						"from":         "users",
-						"localField":   "author",
-						"foreignField": "_id",
-						"as":           "author",
-					},
-				},
-			}
-
-			lookupCommunity := bson.D{
-				primitive.E{
-					Key: "$lookup",
-					Value: bson.M{
-						"from":         "communities",
-						"localField":   "community",
-						"foreignField": "_id",
-						"as":           "community",
-					},
-				},
-			}
-
-			sort := bson.D{
-				primitive.E{
-					Key: "$sort",
-					Value: bson.D{primitive.E{
-						Key:   "upvotes",
-						Value: -1,
-					}, primitive.E{
-						Key:   "date",
-						Value: -1,
-					}},
-				},
-			}
-
-			skip := bson.D{
-				primitive.E{
-					Key:   "$skip",
-					Value: (page - 1) * postLimit,
-				},
-			}
-
-			limit := bson.D{
-				primitive.E{
-					Key:   "$limit",
-					Value: postLimit,
-				},
-			}
-
-			opts := options.Aggregate().SetMaxTime(2 * time.Second)
-
-			cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
-				match,
-				project,
-				lookupAuthor,
-				lookupCommunity,
-				sort,
-				skip,
-				limit,
-			}, opts)
-
+			results, err := newPostQuery(bson.D{primitive.E{Key: "community", Value: communityID}}).
+				withRank(rank).
+				withPage(page).
+				withViewer(oID).
+				find(request.Context(), db)
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.WriteError(response, request, err)
 				return
 			}
 
-			results := []bson.M{}
-			if err = cursor.All(context.TODO(), &results); err != nil {
-				log.Fatal(err)
-			}
-
-			mapped := make([]bson.M, len(results))
-			for i, v := range results {
-				v["author"] = formatAuthor(v["author"].(primitive.A)[0].(primitive.M))
-				v["community"] = formatCommunity(v["community"].(primitive.A)[0].(primitive.M))
-				mapped[i] = v
-			}
-
-			json.NewEncoder(response).Encode(mapped)
+			page.Write(response, results)
 		}
 	}
 }
 
 // CommunityPosts fetch given community posts from database
-func CommunityPosts(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func CommunityPosts(db *mongo.Database, conf config.Server) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 
 		params := mux.Vars(request)
-		page, err := strconv.Atoi(params["page"])
+		rank, err := rankingFromRequest(request, "new")
 		if err != nil {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.Write(response, request, apierror.InvalidSort)
+			return
+		}
+		page, err := pagination.FromRequest(request, conf.PostLimit, rank.sort)
+		if err != nil {
+			apierror.Write(response, request, apierror.InvalidPage)
 			return
 		}
-		postLimit, _ := strconv.Atoi(os.Getenv("POST_LIMIT"))
 		authID, _, ok := request.BasicAuth()
 
 		if ok {
-			collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("posts")
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-
-			defer cancel()
-
 			communityID, _ := primitive.ObjectIDFromHex(params["id"])
 			oID, _ := primitive.ObjectIDFromHex(authID)
 
-			match := bson.D{
-				primitive.E{
-					Key: "$match",
-					Value: bson.D{
-						primitive.E{Key: "community", Value: communityID},
-					},
-				},
-			}
-
-			project := bson.D{
-				primitive.E{
-					Key: "$project",
-					Value: bson.D{
-						primitive.E{Key: "_id", Value: "$_id"},
-						primitive.E{Key: "community", Value: "$community"},
-						primitive.E{Key: "images", Value: "$images"},
-						primitive.E{Key: "tags", Value: "$tags"},
-						primitive.E{Key: "title", Value: "$title"},
-						primitive.E{Key: "content", Value: "$content"},
-						primitive.E{Key: "date", Value: "$date"},
-						primitive.E{Key: "author", Value: "$author"},
-						primitive.E{Key: "upvoted", Value: bson.D{
-							primitive.E{Key: "$in", Value: []interface{}{oID, "$upvotes"}},
-						}},
-						primitive.E{Key: "answers", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$answers"},
-						}},
-						primitive.E{Key: "upvotes", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$upvotes"},
-						}},
-					},
-				},
+			results, err := newPostQuery(bson.D{primitive.E{Key: "community", Value: communityID}}).
+				withRank(rank).
+				withPage(page).
+				withViewer(oID).
+				find(request.Context(), db)
+			if err != nil {
+				apierror.WriteError(response, request, err)
+				return
 			}
 
-			lookupAuthor := bson.D{
-				primitive.E{
-					Key: "$lookup",
-					Value: bson.M{
-						"from":         "users",
-						"localField":   "author",
-						"foreignField": "_id",
-						"as":           "author",
-					},
-				},
-			}
+			page.Write(response, results)
+		}
+	}
+}
 
-			lookupCommunity := bson.D{
-				primitive.E{
-					Key: "$lookup",
-					Value: bson.M{
-						"from":         "communities",
-						"localField":   "community",
-						"foreignField": "_id",
-						"as":           "community",
-					},
-				},
-			}
+// TagPosts fetch posts with given tag from database
+func TagPosts(db *mongo.Database, conf config.Server) func(response http.ResponseWriter, request *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
 
-			sort := bson.D{
-				primitive.E{
-					Key: "$sort",
-					Value: bson.D{primitive.E{
-						Key:   "date",
-						Value: -1,
-					}},
-				},
-			}
+		params := mux.Vars(request)
+		page, err := pagination.FromRequest(request, conf.PostLimit, newestFirst)
+		if err != nil {
+			apierror.Write(response, request, apierror.InvalidPage)
+			return
+		}
+		authID, _, ok := request.BasicAuth()
 
-			skip := bson.D{
-				primitive.E{
-					Key:   "$skip",
-					Value: (page - 1) * postLimit,
-				},
-			}
+		if ok {
+			tag := tags.Normalize(params["tag"])
+			oID, _ := primitive.ObjectIDFromHex(authID)
 
-			limit := bson.D{
-				primitive.E{
-					Key:   "$limit",
-					Value: postLimit,
-				},
+			if tag == "" {
+				apierror.Write(response, request, apierror.InvalidTag)
+				return
 			}
 
-			opts := options.Aggregate().SetMaxTime(2 * time.Second)
-
-			cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
-				match,
-				project,
-				lookupAuthor,
-				lookupCommunity,
-				sort,
-				skip,
-				limit,
-			}, opts)
-
+			results, err := newPostQuery(bson.D{primitive.E{Key: "tags", Value: tag}}).
+				withPage(page).
+				withViewer(oID).
+				find(request.Context(), db)
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.WriteError(response, request, err)
 				return
 			}
 
-			results := []bson.M{}
-			if err = cursor.All(context.TODO(), &results); err != nil {
-				log.Fatal(err)
-			}
-
-			mapped := make([]bson.M, len(results))
-			for i, v := range results {
-				v["author"] = formatAuthor(v["author"].(primitive.A)[0].(primitive.M))
-				v["community"] = formatCommunity(v["community"].(primitive.A)[0].(primitive.M))
-				mapped[i] = v
-			}
-
-			json.NewEncoder(response).Encode(mapped)
+			page.Write(response, results)
 		}
 	}
 }
 
 // CommunityFeed fetch given users community feed from database
-func CommunityFeed(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func CommunityFeed(db *mongo.Database, conf config.Server) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 
-		params := mux.Vars(request)
-		page, err := strconv.Atoi(params["page"])
+		page, err := pagination.FromRequest(request, conf.PostLimit, newestFirst)
 		if err != nil {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.Write(response, request, apierror.InvalidPage)
 			return
 		}
-		postLimit, _ := strconv.Atoi(os.Getenv("POST_LIMIT"))
 		authID, _, ok := request.BasicAuth()
 
 		if ok {
-			postsCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("posts")
-			usersCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-
-			defer cancel()
-
 			oID, _ := primitive.ObjectIDFromHex(authID)
 
-			var user bson.M
-			userOpts := options.FindOne().SetProjection(bson.D{
-				primitive.E{Key: "communities", Value: "$communities"},
-			})
-			err := usersCollection.FindOne(
-				ctx,
-				bson.D{primitive.E{Key: "_id", Value: oID}},
-				userOpts,
-			).Decode(&user)
+			joined, err := edges.Targets(request.Context(), db, edges.Membership, oID)
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.WriteError(response, request, err)
 				return
 			}
 
-			communities := make([]interface{}, len(user["communities"].(primitive.A))+1)
-			for i, v := range user["communities"].(primitive.A) {
+			communities := make([]interface{}, len(joined), len(joined)+1)
+			for i, v := range joined {
 				communities[i] = v
 			}
 			communities = append(communities, "$community")
 
-			match := bson.D{
-				primitive.E{
-					Key: "$match",
-					Value: bson.D{
-						primitive.E{Key: "community", Value: bson.D{primitive.E{
-							Key:   "$in",
-							Value: communities,
-						}}},
-					},
-				},
-			}
-
-			project := bson.D{
-				primitive.E{
-					Key: "$project",
-					Value: bson.D{
-						primitive.E{Key: "_id", Value: "$_id"},
-						primitive.E{Key: "community", Value: "$community"},
-						primitive.E{Key: "images", Value: "$images"},
-						primitive.E{Key: "tags", Value: "$tags"},
-						primitive.E{Key: "title", Value: "$title"},
-						primitive.E{Key: "content", Value: "$content"},
-						primitive.E{Key: "date", Value: "$date"},
-						primitive.E{Key: "author", Value: "$author"},
-						primitive.E{Key: "upvoted", Value: bson.D{
-							primitive.E{Key: "$in", Value: []interface{}{oID, "$upvotes"}},
-						}},
-						primitive.E{Key: "answers", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$answers"},
-						}},
-						primitive.E{Key: "upvotes", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$upvotes"},
-						}},
-					},
-				},
-			}
-
-			lookupAuthor := bson.D{
-				primitive.E{
-					Key: "$lookup",
-					Value: bson.M{
-						"from":         "users",
-						"localField":   "author",
-						"foreignField": "_id",
-						"as":           "author",
-					},
-				},
-			}
-
-			lookupCommunity := bson.D{
-				primitive.E{
-					Key: "$lookup",
-					Value: bson.M{
-						"from":         "communities",
-						"localField":   "community",
-						"foreignField": "_id",
-						"as":           "community",
-					},
-				},
-			}
-
-			sort := bson.D{
-				primitive.E{
-					Key: "$sort",
-					Value: bson.D{primitive.E{
-						Key:   "date",
-						Value: -1,
-					}},
-				},
+			filter := bson.D{
+				primitive.E{Key: "community", Value: bson.D{primitive.E{
+					Key:   "$in",
+					Value: communities,
+				}}},
 			}
 
-			skip := bson.D{
-				primitive.E{
-					Key:   "$skip",
-					Value: (page - 1) * postLimit,
-				},
-			}
-
-			limit := bson.D{
-				primitive.E{
-					Key:   "$limit",
-					Value: postLimit,
-				},
-			}
-
-			opts := options.Aggregate().SetMaxTime(2 * time.Second)
-
-			cursor, err := postsCollection.Aggregate(ctx, mongo.Pipeline{
-				match,
-				project,
-				lookupAuthor,
-				lookupCommunity,
-				sort,
-				skip,
-				limit,
-			}, opts)
-
+			results, err := newPostQuery(filter).
+				withPage(page).
+				withViewer(oID).
+				find(request.Context(), db)
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.WriteError(response, request, err)
 				return
 			}
 
-			results := []bson.M{}
-			if err = cursor.All(context.TODO(), &results); err != nil {
-				log.Fatal(err)
-			}
-
-			mapped := make([]bson.M, len(results))
-			for i, v := range results {
-				v["author"] = formatAuthor(v["author"].(primitive.A)[0].(primitive.M))
-				v["community"] = formatCommunity(v["community"].(primitive.A)[0].(primitive.M))
-				mapped[i] = v
-			}
-
-			json.NewEncoder(response).Encode(mapped)
+			page.Write(response, results)
 		}
 	}
 }
 
 // DeletePost delete post from database
-func DeletePost(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func DeletePost(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 		params := mux.Vars(request)
 
-		postCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("posts")
-		commentsCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("comments")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		postCollection := db.Collection("posts")
+		commentsCollection := db.Collection("comments")
+		ctx, cancel := database.Query(request.Context())
 
 		defer cancel()
 
@@ -955,31 +463,69 @@ func DeletePost(db *mongo.Client) func(response http.ResponseWriter, request *ht
 
 			id, err := primitive.ObjectIDFromHex(params["id"])
 			if err != nil {
-				response.WriteHeader(http.StatusBadRequest)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.Write(response, request, apierror.InvalidID)
 				return
 			}
 
 			var result bson.M
 			postFilter := bson.D{primitive.E{Key: "_id", Value: id}}
-			opts := options.FindOne().SetProjection(bson.D{primitive.E{Key: "author", Value: "$author"}})
-			postCollection.FindOne(ctx, postFilter, opts).Decode(&result)
-
-			if result["author"] == nil {
-				response.WriteHeader(http.StatusNotFound)
-				response.Write([]byte(`{ "message": "Post Not Found" }`))
+			opts := options.FindOne().SetProjection(bson.D{
+				primitive.E{Key: "author", Value: "$author"},
+				primitive.E{Key: "tags", Value: "$tags"},
+			})
+			err = postCollection.FindOne(ctx, postFilter, opts).Decode(&result)
+			if err == mongo.ErrNoDocuments || (err == nil && result["author"] == nil) {
+				apierror.Write(response, request, apierror.PostNotFound)
+				return
+			}
+			if err != nil {
+				apierror.WriteError(response, request, err)
 				return
 			}
 
 			if result["author"] != oID {
-				response.WriteHeader(http.StatusUnauthorized)
-				response.Write([]byte(`{ "message": "Unauthorized" }`))
+				apierror.Write(response, request, apierror.Forbidden)
+				return
+			}
+
+			// Once deleting starts it has to finish even if the client goes away
+			followup, cancelFollowup := database.Batch(context.WithoutCancel(request.Context()))
+
+			defer cancelFollowup()
+
+			// Only the request that deleted the post releases what it held
+			deleted, err := postCollection.DeleteOne(followup, postFilter)
+			if err != nil {
+				apierror.WriteError(response, request, err)
+				return
+			}
+			if deleted.DeletedCount == 0 {
+				apierror.Write(response, request, apierror.PostNotFound)
 				return
 			}
 
 			commentFilter := bson.D{primitive.E{Key: "post", Value: id}}
-			commentsCollection.DeleteMany(ctx, commentFilter)
-			postCollection.FindOneAndDelete(ctx, postFilter)
+			if _, err = commentsCollection.DeleteMany(followup, commentFilter); err != nil {
+				logger.FromRequest(request).Error("Failed to remove post comments", "error", err)
+			}
+			if err = timeline.RemovePost(followup, db, id); err != nil {
+				logger.FromRequest(request).Error("Failed to remove post from timelines", "error", err)
+			}
+			if err = edges.RemoveAll(followup, db, edges.Vote, edges.Vote.To, id); err != nil {
+				logger.FromRequest(request).Error("Failed to remove post votes", "error", err)
+			}
+
+			if postTags, ok := result["tags"].(primitive.A); ok {
+				names := []string{}
+				for _, tag := range postTags {
+					if name, ok := tag.(string); ok {
+						names = append(names, name)
+					}
+				}
+				if err = tags.ReleaseUsage(followup, db, names); err != nil {
+					logger.FromRequest(request).Error("Failed to release tag usage", "error", err)
+				}
+			}
 
 			response.Write([]byte(`{ "message": "OK" }`))
 		}
@@ -987,8 +533,39 @@ func DeletePost(db *mongo.Client) func(response http.ResponseWriter, request *ht
 	}
 }
 
+// Upvoters fetch users who upvoted given post
+func Upvoters(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+		params := mux.Vars(request)
+
+		id, err := primitive.ObjectIDFromHex(params["id"])
+		if err != nil {
+			apierror.Write(response, request, apierror.InvalidID)
+			return
+		}
+		page, err := pagination.FromRequest(request, edges.ListLimit, edges.NewestFirst)
+		if err != nil {
+			apierror.Write(response, request, apierror.InvalidPage)
+			return
+		}
+
+		_, _, ok := request.BasicAuth()
+
+		if ok {
+			results, err := edges.Users(request.Context(), db, edges.Vote, edges.Vote.To, id, page)
+			if err != nil {
+				apierror.WriteError(response, request, err)
+				return
+			}
+
+			page.Write(response, results)
+		}
+	}
+}
+
 // PostAction is for upvoting and downvoting posts
-func PostAction(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func PostAction(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 		actionType := mux.Vars(request)["type"]
@@ -1002,61 +579,94 @@ func PostAction(db *mongo.Client) func(response http.ResponseWriter, request *ht
 
 			if err == nil {
 				if actionType == "upvote" {
-					upvote(db, response, request, oID, action.ID)
+					setUpvote(db, response, request, oID, action.ID, true)
 					return
 				} else if actionType == "downvote" {
-					downvote(db, response, request, oID, action.ID)
+					setUpvote(db, response, request, oID, action.ID, false)
 					return
 				}
 			} else {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.Write(response, request, apierror.InvalidBody)
 				return
 			}
 
 		}
 
-		response.WriteHeader(http.StatusNotFound)
-		response.Write([]byte(`{ "message": "Not Found" }`))
+		apierror.Write(response, request, apierror.NotFound)
 		return
 	}
 }
 
-func upvote(
-	db *mongo.Client,
+// Upvote upvotes given post on PUT and takes the upvote back on DELETE,
+// repeated requests leave the post as it is and respond the same
+func Upvote(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+		params := mux.Vars(request)
+
+		id, err := primitive.ObjectIDFromHex(params["id"])
+		if err != nil {
+			apierror.Write(response, request, apierror.InvalidID)
+			return
+		}
+
+		authID, _, ok := request.BasicAuth()
+
+		if ok {
+			oID, _ := primitive.ObjectIDFromHex(authID)
+			setUpvote(db, response, request, oID, id, request.Method == http.MethodPut)
+		}
+	}
+}
+
+// setUpvote brings upvote of upvoterID on postID to given state and responds
+// the resulting state of the post
+func setUpvote(
+	db *mongo.Database,
 	response http.ResponseWriter,
 	request *http.Request,
 	upvoterID primitive.ObjectID,
 	postID primitive.ObjectID,
-) error {
-	collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("posts")
-	usersCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	upvoted bool,
+) {
+	collection := db.Collection("posts")
+	usersCollection := db.Collection("users")
+	ctx, cancel := database.Query(request.Context())
 
 	defer cancel()
 
-	results := upvoted(db, response, request, upvoterID, postID)
-
-	if len(results) > 0 {
-		if results[0]["upvoted"].(bool) {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "Post already upvoted" }`))
-			return nil
-		}
-		updateOpts := options.FindOneAndUpdate().SetUpsert(true)
-
-		filter := bson.D{primitive.E{Key: "_id", Value: postID}}
-		update := bson.D{primitive.E{
-			Key: "$push", Value: bson.D{primitive.E{Key: "upvotes", Value: upvoterID}},
-		}}
-		collection.FindOneAndUpdate(ctx, filter, update, updateOpts)
+	changed, err := edges.Set(request.Context(), db, edges.Vote, upvoterID, postID, upvoted, edges.Counter{
+		Collection: "posts",
+		ID:         postID,
+		Field:      "upvoteCount",
+	})
+	if err == edges.ErrNotFound {
+		apierror.Write(response, request, apierror.PostNotFound)
+		return
+	}
+	if err != nil {
+		apierror.WriteError(response, request, err)
+		return
+	}
 
-		// Send notification
-		var upvoter, upvotee, post bson.M
+	var post bson.M
+	readOpts := options.FindOne().SetProjection(bson.D{
+		primitive.E{Key: "author", Value: "$author"},
+		primitive.E{Key: "upvoteCount", Value: "$upvoteCount"},
+	})
+	err = collection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: postID}}, readOpts).Decode(&post)
+	if err == mongo.ErrNoDocuments {
+		apierror.Write(response, request, apierror.PostNotFound)
+		return
+	}
+	if err != nil {
+		apierror.WriteError(response, request, err)
+		return
+	}
 
-		readOpts := options.FindOne().SetProjection(bson.D{primitive.E{Key: "author", Value: "$author"}})
-		filter = bson.D{primitive.E{Key: "_id", Value: postID}}
-		collection.FindOne(ctx, filter, readOpts).Decode(&post)
+	// Send notification
+	if changed && upvoted {
+		var upvoter, upvotee bson.M
 
 		opts := options.FindOne().SetProjection(bson.D{
 			primitive.E{Key: "_id", Value: "$_id"},
@@ -1068,194 +678,29 @@ func upvote(
 		usersCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: post["author"]}}, opts).Decode(&upvotee)
 
 		if upvoter["_id"] != upvotee["_id"] {
-			notification.SendNotification(post["author"].(primitive.ObjectID), messaging.Notification{
+			notification.SendNotification(request.Context(), post["author"].(primitive.ObjectID), messaging.Notification{
 				Title: config.Languages[upvotee["language"].(string)].UpvoteTitle(),
 				Body:  config.Languages[upvotee["language"].(string)].PostUpvote(upvoter["fullname"].(string) + " (@" + upvoter["username"].(string) + ")"),
 			}, db)
 		}
-
-		response.Write([]byte(`{ "message": "OK" }`))
-		return nil
-	}
-
-	response.WriteHeader(http.StatusNotFound)
-	response.Write([]byte(`{ "message": "Post Not Found" }`))
-	return nil
-}
-
-func downvote(
-	db *mongo.Client,
-	response http.ResponseWriter,
-	request *http.Request,
-	upvoterID primitive.ObjectID,
-	postID primitive.ObjectID,
-) error {
-	collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("posts")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-
-	defer cancel()
-
-	results := upvoted(db, response, request, upvoterID, postID)
-
-	if len(results) > 0 {
-		if results[0]["upvoted"].(bool) == false {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "Post already downvoted" }`))
-			return nil
-		}
-		updateOpts := options.FindOneAndUpdate().SetUpsert(true)
-
-		filter := bson.D{primitive.E{Key: "_id", Value: postID}}
-		update := bson.D{primitive.E{
-			Key: "$pull", Value: bson.D{primitive.E{Key: "upvotes", Value: upvoterID}},
-		}}
-		collection.FindOneAndUpdate(ctx, filter, update, updateOpts)
-
-		response.Write([]byte(`{ "message": "OK" }`))
-		return nil
-	}
-
-	response.WriteHeader(http.StatusNotFound)
-	response.Write([]byte(`{ "message": "Post Not Found" }`))
-	return nil
-}
-
-func upvoted(
-	db *mongo.Client,
-	response http.ResponseWriter,
-	request *http.Request,
-	upvoterID primitive.ObjectID,
-	postID primitive.ObjectID,
-) []bson.M {
-	collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("posts")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-
-	defer cancel()
-
-	aggregateOpts := options.Aggregate().SetMaxTime(2 * time.Second)
-	match := bson.D{
-		primitive.E{Key: "$match", Value: bson.D{primitive.E{Key: "_id", Value: postID}}},
-	}
-	project := bson.D{
-		primitive.E{
-			Key: "$project",
-			Value: bson.D{
-				primitive.E{Key: "upvoted", Value: bson.D{
-					primitive.E{Key: "$in", Value: []interface{}{upvoterID, "$upvotes"}},
-				}},
-			},
-		},
-	}
-	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{match, project}, aggregateOpts)
-
-	if err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
-		response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
-		return nil
 	}
 
-	var results []bson.M
-	if err = cursor.All(ctx, &results); err != nil {
-		log.Fatal(err)
-	}
-
-	return results
-}
-
-func formatAuthor(author primitive.M) primitive.M {
-	result := primitive.M{}
-
-	result["_id"] = author["_id"]
-	result["fullname"] = author["fullname"]
-	result["username"] = author["username"]
-	result["image"] = author["image"]
-	result["verified"] = author["verified"]
-
-	return result
-}
-
-func formatCommunity(community primitive.M) primitive.M {
-	result := primitive.M{}
-
-	result["_id"] = community["_id"]
-	result["title"] = community["title"]
-	result["image"] = community["image"]
-
-	return result
+	json.NewEncoder(response).Encode(bson.M{
+		"upvoted": upvoted,
+		"upvotes": post["upvoteCount"],
+	})
 }
 
 // AnonymousPost fetch anonymous post for embedding
-func AnonymousPost(db *mongo.Client, id primitive.ObjectID) (bson.M, error) {
-	collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("posts")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-
-	defer cancel()
-
-	match := bson.D{
-		primitive.E{
-			Key: "$match",
-			Value: bson.D{
-				primitive.E{Key: "_id", Value: id},
-			},
-		},
-	}
-
-	project := bson.D{
-		primitive.E{
-			Key: "$project",
-			Value: bson.D{
-				primitive.E{Key: "_id", Value: "$_id"},
-				primitive.E{Key: "community", Value: "$community"},
-				primitive.E{Key: "images", Value: "$images"},
-				primitive.E{Key: "tags", Value: "$tags"},
-				primitive.E{Key: "title", Value: "$title"},
-				primitive.E{Key: "content", Value: "$content"},
-				primitive.E{Key: "date", Value: "$date"},
-				primitive.E{Key: "author", Value: "$author"},
-				primitive.E{Key: "answers", Value: bson.D{
-					primitive.E{Key: "$size", Value: "$answers"},
-				}},
-				primitive.E{Key: "upvotes", Value: bson.D{
-					primitive.E{Key: "$size", Value: "$upvotes"},
-				}},
-			},
-		},
-	}
-
-	lookupAuthor := bson.D{
-		primitive.E{
-			Key: "$lookup",
-			Value: bson.M{
-				"from":         "users",
-				"localField":   "author",
-				"foreignField": "_id",
-				"as":           "author",
-			},
-		},
-	}
-
-	opts := options.Aggregate().SetMaxTime(2 * time.Second)
-
-	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
-		match,
-		project,
-		lookupAuthor,
-	}, opts)
-
+func AnonymousPost(ctx context.Context, db *mongo.Database, id primitive.ObjectID) (*views.PostView, error) {
+	results, err := newPostQuery(bson.D{primitive.E{Key: "_id", Value: id}}).find(ctx, db)
 	if err != nil {
 		return nil, err
 	}
 
-	results := []bson.M{}
-	if err = cursor.All(context.TODO(), &results); err != nil {
-		log.Fatal(err)
-	}
-
 	if len(results) == 0 {
-		return nil, errors.New("Not Found")
+		return nil, mongo.ErrNoDocuments
 	}
 
-	results[0]["author"] = formatAuthor(results[0]["author"].(primitive.A)[0].(primitive.M))
-
-	return results[0], nil
+	return &results[0], nil
 }
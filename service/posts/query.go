@@ -0,0 +1,109 @@
+package posts
+
+import (
+	"context"
+	"jt-api/database"
+	"jt-api/edges"
+	"jt-api/pagination"
+	"jt-api/tracing"
+	"jt-api/views"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// postQuery builds the aggregation pipeline of a post listing
+//
+// Posts matching the filter are narrowed down by the ranking window and the
+// cursor of the page, projected into views.PostView, sorted and sliced by the
+// page, flagged as upvoted for
+// the viewer and hydrated with their authors and communities, in that order
+type postQuery struct {
+	filter bson.D
+	rank   ranking
+	page   *pagination.Page
+	viewer primitive.ObjectID
+}
+
+// newPostQuery starts a query of the posts matching filter
+func newPostQuery(filter bson.D) *postQuery {
+	return &postQuery{filter: filter}
+}
+
+// withRank restricts the query to the window of the ranking, the sort order of
+// the ranking is applied by the page
+func (query *postQuery) withRank(rank ranking) *postQuery {
+	query.rank = rank
+	return query
+}
+
+// withPage sorts and slices the query, queries without a page return every
+// matching post unsorted
+func (query *postQuery) withPage(page pagination.Page) *postQuery {
+	query.page = &page
+	return query
+}
+
+// withViewer flags the posts the viewer upvoted
+func (query *postQuery) withViewer(viewer primitive.ObjectID) *postQuery {
+	query.viewer = viewer
+	return query
+}
+
+// pipeline returns the aggregation pipeline of the query
+func (query *postQuery) pipeline() mongo.Pipeline {
+	pipeline := mongo.Pipeline{}
+
+	if len(query.filter) > 0 {
+		pipeline = append(pipeline, bson.D{primitive.E{Key: "$match", Value: query.filter}})
+	}
+	if stage := query.rank.stage(); stage != nil {
+		pipeline = append(pipeline, stage)
+	}
+	if query.page != nil {
+		pipeline = append(pipeline, query.page.Match()...)
+	}
+
+	pipeline = append(pipeline, bson.D{primitive.E{Key: "$project", Value: views.PostFields}})
+
+	if query.page != nil {
+		pipeline = append(pipeline, query.page.Stages()...)
+	}
+	if !query.viewer.IsZero() {
+		pipeline = append(pipeline, edges.Flag(edges.Vote, query.viewer, "upvoted")...)
+	}
+
+	pipeline = append(pipeline, views.LookupUser("author")...)
+	pipeline = append(pipeline, views.LookupCommunity("community")...)
+
+	return pipeline
+}
+
+// find runs the query within ctx, the aggregation and its lookups are traced
+// as one span
+func (query *postQuery) find(ctx context.Context, db *mongo.Database) (results []views.PostView, err error) {
+	ctx, span := tracing.Start(ctx, "posts.query", attribute.Int("stages", len(query.pipeline())))
+
+	defer func() { tracing.End(span, err) }()
+
+	collection := db.Collection("posts")
+	ctx, cancel := database.Query(ctx)
+
+	defer cancel()
+
+	opts := database.Aggregate()
+
+	cursor, err := collection.Aggregate(ctx, query.pipeline(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	results = []views.PostView{}
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
@@ -0,0 +1,163 @@
+package posts
+
+import (
+	"jt-api/edges"
+	"jt-api/pagination"
+	"jt-api/views"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestPostQueryPipeline(t *testing.T) {
+	community := primitive.NewObjectID()
+	viewer := primitive.NewObjectID()
+	last := primitive.NewObjectID()
+	date := primitive.NewDateTimeFromTime(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC))
+
+	filter := bson.D{primitive.E{Key: "community", Value: community}}
+	window := ranking{
+		sort:   mostUpvoted,
+		filter: bson.D{primitive.E{Key: "date", Value: bson.D{primitive.E{Key: "$gte", Value: date}}}},
+	}
+
+	match := bson.D{primitive.E{Key: "$match", Value: filter}}
+	project := bson.D{primitive.E{Key: "$project", Value: views.PostFields}}
+	lookups := append(views.LookupUser("author"), views.LookupCommunity("community")...)
+
+	pipeline := func(stages ...[]bson.D) mongo.Pipeline {
+		result := mongo.Pipeline{}
+		for _, stage := range stages {
+			result = append(result, stage...)
+		}
+		return result
+	}
+
+	tests := []struct {
+		name     string
+		query    *postQuery
+		expected mongo.Pipeline
+	}{
+		{
+			name:     "filter only",
+			query:    newPostQuery(filter),
+			expected: pipeline([]bson.D{match, project}, lookups),
+		},
+		{
+			name:     "no filter",
+			query:    newPostQuery(bson.D{}),
+			expected: pipeline([]bson.D{project}, lookups),
+		},
+		{
+			name:  "first page newest first",
+			query: newPostQuery(filter).withPage(pagination.Page{Limit: 10, Sort: newestFirst}),
+			expected: pipeline([]bson.D{
+				match,
+				project,
+				{primitive.E{Key: "$sort", Value: bson.D{
+					primitive.E{Key: "date", Value: -1},
+					primitive.E{Key: "_id", Value: -1},
+				}}},
+				{primitive.E{Key: "$limit", Value: 11}},
+			}, lookups),
+		},
+		{
+			name:  "legacy page",
+			query: newPostQuery(filter).withPage(pagination.Page{Number: 3, Limit: 10, Sort: newestFirst}),
+			expected: pipeline([]bson.D{
+				match,
+				project,
+				{primitive.E{Key: "$sort", Value: bson.D{
+					primitive.E{Key: "date", Value: -1},
+					primitive.E{Key: "_id", Value: -1},
+				}}},
+				{primitive.E{Key: "$skip", Value: 20}},
+				{primitive.E{Key: "$limit", Value: 10}},
+			}, lookups),
+		},
+		{
+			name: "ranked page after cursor for viewer",
+			query: newPostQuery(filter).
+				withRank(window).
+				withPage(pagination.Page{
+					Limit:  10,
+					Sort:   window.sort,
+					Cursor: &pagination.Cursor{Values: primitive.A{int32(5), date}, ID: last},
+				}).
+				withViewer(viewer),
+			expected: pipeline([]bson.D{
+				match,
+				{primitive.E{Key: "$match", Value: window.filter}},
+				{primitive.E{Key: "$match", Value: bson.D{primitive.E{Key: "$or", Value: []interface{}{
+					bson.D{primitive.E{Key: "upvoteCount", Value: bson.D{primitive.E{Key: "$lt", Value: int32(5)}}}},
+					bson.D{
+						primitive.E{Key: "upvoteCount", Value: int32(5)},
+						primitive.E{Key: "date", Value: bson.D{primitive.E{Key: "$lt", Value: date}}},
+					},
+					bson.D{
+						primitive.E{Key: "upvoteCount", Value: int32(5)},
+						primitive.E{Key: "date", Value: date},
+						primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: "$lt", Value: last}}},
+					},
+				}}}}},
+				project,
+				{primitive.E{Key: "$sort", Value: bson.D{
+					primitive.E{Key: "upvotes", Value: -1},
+					primitive.E{Key: "date", Value: -1},
+					primitive.E{Key: "_id", Value: -1},
+				}}},
+				{primitive.E{Key: "$limit", Value: 11}},
+			}, edges.Flag(edges.Vote, viewer, "upvoted"), lookups),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if actual := test.query.pipeline(); !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("pipeline\n got: %v\nwant: %v", actual, test.expected)
+			}
+		})
+	}
+}
+
+func TestRankingSort(t *testing.T) {
+	tests := []struct {
+		url      string
+		expected []pagination.SortField
+		filtered bool
+	}{
+		{url: "/posts", expected: newestFirst},
+		{url: "/posts?sort=hot", expected: hottestFirst},
+		{url: "/posts?sort=rising", expected: risingFirst, filtered: true},
+		{url: "/posts?sort=top", expected: mostUpvoted},
+		{url: "/posts?sort=top&t=week", expected: mostUpvoted, filtered: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.url, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, test.url, nil)
+
+			rank, err := rankingFromRequest(request, "new")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rank.sort, test.expected) {
+				t.Errorf("sort %v, want %v", rank.sort, test.expected)
+			}
+			if filtered := rank.stage() != nil; filtered != test.filtered {
+				t.Errorf("filtered %v, want %v", filtered, test.filtered)
+			}
+		})
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/posts?sort=top&t=decade", nil)
+	if _, err := rankingFromRequest(request, "new"); err != errUnknownSort {
+		t.Errorf("unknown window: %v, want %v", err, errUnknownSort)
+	}
+}
@@ -0,0 +1,206 @@
+package posts
+
+import (
+	"context"
+	"errors"
+	"jt-api/database"
+	"jt-api/pagination"
+	"log/slog"
+	"math"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Scores are only kept for posts younger than scoreWindow, older posts have
+// decayed to practically nothing and are reset to zero
+const (
+	scoreWindow   = 7 * 24 * time.Hour
+	risingWindow  = 24 * time.Hour
+	hotGravity    = 1.8
+	answersWeight = 2
+)
+
+// initialHotScore is the hot score of a post without any votes or answers
+var initialHotScore = 1 / math.Pow(2, hotGravity)
+
+var errUnknownSort = errors.New("Unknown sort")
+
+// Windows of the top sort mode
+var topWindows = map[string]time.Duration{
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
+	"all":   0,
+}
+
+var (
+	hottestFirst = []pagination.SortField{{Key: "hot", Order: -1, Kind: pagination.Number}}
+	risingFirst  = []pagination.SortField{{Key: "rising", Order: -1, Kind: pagination.Number}}
+)
+
+// ranking is a selectable sort mode of post listings
+type ranking struct {
+	sort   []pagination.SortField
+	filter bson.D
+}
+
+// rankingFromRequest reads sort mode from "sort" and "t" query parameters
+func rankingFromRequest(request *http.Request, fallback string) (ranking, error) {
+	query := request.URL.Query()
+	mode := query.Get("sort")
+	if mode == "" {
+		mode = fallback
+	}
+
+	switch mode {
+	case "new":
+		return ranking{sort: newestFirst}, nil
+	case "hot":
+		return ranking{sort: hottestFirst}, nil
+	case "rising":
+		return ranking{sort: risingFirst, filter: since(risingWindow)}, nil
+	case "top":
+		window := query.Get("t")
+		if window == "" {
+			window = "all"
+		}
+		duration, ok := topWindows[window]
+		if !ok {
+			return ranking{}, errUnknownSort
+		}
+		if duration == 0 {
+			return ranking{sort: mostUpvoted}, nil
+		}
+		return ranking{sort: mostUpvoted, filter: since(duration)}, nil
+	}
+
+	return ranking{}, errUnknownSort
+}
+
+// stage returns the $match stage of the ranking, nil if it does not filter
+func (rank ranking) stage() bson.D {
+	if len(rank.filter) == 0 {
+		return nil
+	}
+
+	return bson.D{primitive.E{Key: "$match", Value: rank.filter}}
+}
+
+func since(duration time.Duration) bson.D {
+	return bson.D{primitive.E{Key: "date", Value: bson.D{
+		primitive.E{Key: "$gte", Value: primitive.NewDateTimeFromTime(time.Now().Add(-duration))},
+	}}}
+}
+
+// RunRankingJob refreshes post scores every interval, blocks until ctx is done
+func RunRankingJob(ctx context.Context, db *mongo.Database, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	defer ticker.Stop()
+
+	for {
+		if err := RefreshScores(ctx, db); err != nil {
+			slog.Error("Failed to refresh post scores", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RefreshScores recomputes hot and rising scores of recent posts
+//
+// Hot score is (upvotes + 2 * answers + 1) / (ageHours + 2) ^ 1.8, rising score
+// is (upvotes + answers) / (ageHours + 1) for posts younger than a day
+func RefreshScores(ctx context.Context, db *mongo.Database) error {
+	collection := db.Collection("posts")
+	ctx, cancel := database.Batch(ctx)
+
+	defer cancel()
+
+	now := time.Now()
+	cutoff := primitive.NewDateTimeFromTime(now.Add(-scoreWindow))
+
+	ageHours := bson.D{primitive.E{Key: "$divide", Value: []interface{}{
+		bson.D{primitive.E{Key: "$subtract", Value: []interface{}{primitive.NewDateTimeFromTime(now), "$date"}}},
+		time.Hour.Milliseconds(),
+	}}}
+	upvotes := bson.D{primitive.E{Key: "$ifNull", Value: []interface{}{"$upvoteCount", 0}}}
+	answers := bson.D{primitive.E{Key: "$ifNull", Value: []interface{}{"$answerCount", 0}}}
+
+	hot := bson.D{primitive.E{Key: "$divide", Value: []interface{}{
+		bson.D{primitive.E{Key: "$add", Value: []interface{}{
+			upvotes,
+			bson.D{primitive.E{Key: "$multiply", Value: []interface{}{answersWeight, answers}}},
+			1,
+		}}},
+		bson.D{primitive.E{Key: "$pow", Value: []interface{}{
+			bson.D{primitive.E{Key: "$add", Value: []interface{}{ageHours, 2}}},
+			hotGravity,
+		}}},
+	}}}
+
+	rising := bson.D{primitive.E{Key: "$cond", Value: []interface{}{
+		bson.D{primitive.E{Key: "$lt", Value: []interface{}{ageHours, risingWindow.Hours()}}},
+		bson.D{primitive.E{Key: "$divide", Value: []interface{}{
+			bson.D{primitive.E{Key: "$add", Value: []interface{}{upvotes, answers}}},
+			bson.D{primitive.E{Key: "$add", Value: []interface{}{ageHours, 1}}},
+		}}},
+		0,
+	}}}
+
+	recent := bson.D{primitive.E{Key: "date", Value: bson.D{primitive.E{Key: "$gte", Value: cutoff}}}}
+	update := mongo.Pipeline{
+		bson.D{primitive.E{Key: "$set", Value: bson.D{
+			primitive.E{Key: "hot", Value: hot},
+			primitive.E{Key: "rising", Value: rising},
+			primitive.E{Key: "scoredAt", Value: primitive.NewDateTimeFromTime(now)},
+		}}},
+	}
+	if _, err := collection.UpdateMany(ctx, recent, update); err != nil {
+		return err
+	}
+
+	stale := bson.D{
+		primitive.E{Key: "date", Value: bson.D{primitive.E{Key: "$lt", Value: cutoff}}},
+		primitive.E{Key: "$or", Value: []interface{}{
+			bson.D{primitive.E{Key: "hot", Value: bson.D{primitive.E{Key: "$ne", Value: 0}}}},
+			bson.D{primitive.E{Key: "rising", Value: bson.D{primitive.E{Key: "$ne", Value: 0}}}},
+		}},
+	}
+	reset := bson.D{primitive.E{Key: "$set", Value: bson.D{
+		primitive.E{Key: "hot", Value: 0},
+		primitive.E{Key: "rising", Value: 0},
+		primitive.E{Key: "scoredAt", Value: primitive.NewDateTimeFromTime(now)},
+	}}}
+	_, err := collection.UpdateMany(ctx, stale, reset)
+	return err
+}
+
+// CreateIndexes creates indexes used by post listings
+func CreateIndexes(db *mongo.Database) error {
+	collection := db.Collection("posts")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{primitive.E{Key: "community", Value: 1}, primitive.E{Key: "date", Value: -1}}},
+		{Keys: bson.D{
+			primitive.E{Key: "community", Value: 1},
+			primitive.E{Key: "upvoteCount", Value: -1},
+			primitive.E{Key: "date", Value: -1},
+		}},
+		{Keys: bson.D{primitive.E{Key: "community", Value: 1}, primitive.E{Key: "hot", Value: -1}}},
+		{Keys: bson.D{primitive.E{Key: "community", Value: 1}, primitive.E{Key: "rising", Value: -1}}},
+	}, options.CreateIndexes())
+	return err
+}
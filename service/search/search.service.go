@@ -3,43 +3,57 @@ package search
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"jt-api/database"
+	"jt-api/logger"
+	"jt-api/service/tags"
+	"jt-api/views"
+	"log/slog"
 	"net/http"
-	"os"
 	"time"
 
 	"github.com/gorilla/mux"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// subqueryTimeout bounds each search subquery on its own, a slow or failing
+// subquery leaves its section empty rather than failing the whole search
+const subqueryTimeout = 3 * time.Second
+
 // ContentResult result model for search calls
 type ContentResult struct {
-	Length      int      `json:"length" bson:"length"`
-	Users       []bson.M `json:"users" bson:"users"`
-	Posts       []bson.M `json:"posts" bson:"posts"`
-	Communities []bson.M `json:"communities" bson:"communities"`
+	Length      int                   `json:"length" bson:"length"`
+	Users       []UserResult          `json:"users" bson:"users"`
+	Posts       []views.PostView      `json:"posts" bson:"posts"`
+	Communities []views.CommunityView `json:"communities" bson:"communities"`
+}
+
+// UserResult is a user found by search
+type UserResult struct {
+	views.UserSummary `bson:",inline"`
+
+	Followers int `json:"followers" bson:"followers"`
 }
 
 // Content is for searching general content
-func Content(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func Content(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 		params := mux.Vars(request)
+		log := logger.FromRequest(request)
 
-		usersCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-		postsCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("posts")
-		communitiesCollection := db.Database(os.Getenv("DATABASE_NAME")).Collection("communities")
+		usersCollection := db.Collection("users")
+		postsCollection := db.Collection("posts")
+		communitiesCollection := db.Collection("communities")
 
-		usersChan := make(chan []bson.M, 1)
-		postsChan := make(chan []bson.M, 1)
-		communitiesChan := make(chan []bson.M, 1)
+		usersChan := make(chan []UserResult, 1)
+		postsChan := make(chan []views.PostView, 1)
+		communitiesChan := make(chan []views.CommunityView, 1)
 
-		go getUserResults(usersChan, usersCollection, params)
-		go getPostResults(postsChan, postsCollection, params)
-		go getCommunityResults(communitiesChan, communitiesCollection, params)
+		go getUserResults(request.Context(), log, usersChan, usersCollection, params)
+		go getPostResults(request.Context(), log, postsChan, postsCollection, params)
+		go getCommunityResults(request.Context(), log, communitiesChan, communitiesCollection, params)
 
 		userResults := <-usersChan
 		postResults := <-postsChan
@@ -56,9 +70,9 @@ func Content(db *mongo.Client) func(response http.ResponseWriter, request *http.
 	}
 }
 
-func getUserResults(channel chan []bson.M, collection *mongo.Collection, params map[string]string) {
-	opts := options.Aggregate().SetMaxTime(2 * time.Second)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func getUserResults(ctx context.Context, log *slog.Logger, channel chan []UserResult, collection *mongo.Collection, params map[string]string) {
+	opts := database.Aggregate()
+	ctx, cancel := context.WithTimeout(ctx, subqueryTimeout)
 
 	defer cancel()
 
@@ -105,9 +119,7 @@ func getUserResults(channel chan []bson.M, collection *mongo.Collection, params
 				primitive.E{Key: "fullname", Value: "$fullname"},
 				primitive.E{Key: "image", Value: "$image"},
 				primitive.E{Key: "verified", Value: "$verified"},
-				primitive.E{Key: "followers", Value: bson.D{
-					primitive.E{Key: "$size", Value: "$followers"},
-				}},
+				primitive.E{Key: "followers", Value: "$followerCount"},
 			},
 		},
 	}
@@ -122,17 +134,21 @@ func getUserResults(channel chan []bson.M, collection *mongo.Collection, params
 		},
 	}
 
-	cursor, _ := collection.Aggregate(ctx, mongo.Pipeline{match, project, sort}, opts)
-	results := []bson.M{}
-	if err := cursor.All(context.TODO(), &results); err != nil {
-		log.Fatal(err)
+	results := []UserResult{}
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{match, project, sort}, opts)
+	if err == nil {
+		err = cursor.All(ctx, &results)
+	}
+	if err != nil {
+		log.Error("Search for users failed", "error", err)
+		results = []UserResult{}
 	}
 	channel <- results
 }
 
-func getPostResults(channel chan []bson.M, collection *mongo.Collection, params map[string]string) {
-	opts := options.Aggregate().SetMaxTime(2 * time.Second)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func getPostResults(ctx context.Context, log *slog.Logger, channel chan []views.PostView, collection *mongo.Collection, params map[string]string) {
+	opts := database.Aggregate()
+	ctx, cancel := context.WithTimeout(ctx, subqueryTimeout)
 
 	defer cancel()
 
@@ -159,7 +175,7 @@ func getPostResults(channel chan []bson.M, collection *mongo.Collection, params
 							Value: bson.D{
 								primitive.E{
 									Key:   "$in",
-									Value: []interface{}{params["query"]},
+									Value: []interface{}{tags.Normalize(params["query"])},
 								},
 							},
 						},
@@ -169,22 +185,7 @@ func getPostResults(channel chan []bson.M, collection *mongo.Collection, params
 		}},
 	}
 
-	project := bson.D{
-		primitive.E{
-			Key: "$project",
-			Value: bson.D{
-				primitive.E{Key: "_id", Value: "$_id"},
-				primitive.E{Key: "title", Value: "$title"},
-				primitive.E{Key: "content", Value: "$content"},
-				primitive.E{Key: "upvotes", Value: bson.D{
-					primitive.E{Key: "$size", Value: "$upvotes"},
-				}},
-				primitive.E{Key: "answers", Value: bson.D{
-					primitive.E{Key: "$size", Value: "$answers"},
-				}},
-			},
-		},
-	}
+	project := bson.D{primitive.E{Key: "$project", Value: views.PostFields}}
 
 	sort := bson.D{
 		primitive.E{
@@ -199,17 +200,24 @@ func getPostResults(channel chan []bson.M, collection *mongo.Collection, params
 		},
 	}
 
-	cursor, _ := collection.Aggregate(ctx, mongo.Pipeline{match, project, sort}, opts)
-	results := []bson.M{}
-	if err := cursor.All(context.TODO(), &results); err != nil {
-		log.Fatal(err)
+	pipeline := mongo.Pipeline{match, project, sort}
+	pipeline = append(pipeline, views.LookupUser("author")...)
+
+	results := []views.PostView{}
+	cursor, err := collection.Aggregate(ctx, pipeline, opts)
+	if err == nil {
+		err = cursor.All(ctx, &results)
+	}
+	if err != nil {
+		log.Error("Search for posts failed", "error", err)
+		results = []views.PostView{}
 	}
 	channel <- results
 }
 
-func getCommunityResults(channel chan []bson.M, collection *mongo.Collection, params map[string]string) {
-	opts := options.Aggregate().SetMaxTime(2 * time.Second)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+func getCommunityResults(ctx context.Context, log *slog.Logger, channel chan []views.CommunityView, collection *mongo.Collection, params map[string]string) {
+	opts := database.Aggregate()
+	ctx, cancel := context.WithTimeout(ctx, subqueryTimeout)
 
 	defer cancel()
 
@@ -242,9 +250,7 @@ func getCommunityResults(channel chan []bson.M, collection *mongo.Collection, pa
 				primitive.E{Key: "_id", Value: "$_id"},
 				primitive.E{Key: "title", Value: "$title"},
 				primitive.E{Key: "image", Value: "$image"},
-				primitive.E{Key: "members", Value: bson.D{
-					primitive.E{Key: "$size", Value: "$members"},
-				}},
+				primitive.E{Key: "members", Value: "$memberCount"},
 			},
 		},
 	}
@@ -259,11 +265,14 @@ func getCommunityResults(channel chan []bson.M, collection *mongo.Collection, pa
 		},
 	}
 
-	cursor, _ := collection.Aggregate(ctx, mongo.Pipeline{match, project, sort}, opts)
-
-	results := []bson.M{}
-	if err := cursor.All(context.TODO(), &results); err != nil {
-		log.Fatal(err)
+	results := []views.CommunityView{}
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{match, project, sort}, opts)
+	if err == nil {
+		err = cursor.All(ctx, &results)
+	}
+	if err != nil {
+		log.Error("Search for communities failed", "error", err)
+		results = []views.CommunityView{}
 	}
 
 	channel <- results
@@ -0,0 +1,439 @@
+package tags
+
+import (
+	"context"
+	"encoding/json"
+	"jt-api/apierror"
+	"jt-api/database"
+	"jt-api/logger"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaxTagLength is the maximum length of a single tag after normalization
+const MaxTagLength = 32
+
+// Trending tags are computed from posts created within trendingWindow, each
+// post counting half as much for every trendingHalfLife it has aged
+const (
+	trendingWindow   = 48 * time.Hour
+	trendingHalfLife = 6 * time.Hour
+	trendingLimit    = 10
+)
+
+var invalidTagCharacters = regexp.MustCompile(`[^\p{L}\p{N}_]`)
+
+// Tag common tag model
+type Tag struct {
+	ID       primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Name     string             `json:"name" bson:"name"`
+	Count    int                `json:"count" bson:"count"`
+	Follows  int                `json:"follows" bson:"follows"`
+	Date     primitive.DateTime `json:"date,omitempty" bson:"date,omitempty"`
+	LastUsed primitive.DateTime `json:"lastUsed,omitempty" bson:"lastUsed,omitempty"`
+}
+
+// TrendingTag result model for trending tags
+type TrendingTag struct {
+	Name  string  `json:"name" bson:"_id"`
+	Posts int     `json:"posts" bson:"posts"`
+	Score float64 `json:"score" bson:"score"`
+}
+
+// TagActionModel is model for following and unfollowing tags
+type TagActionModel struct {
+	Tag string `json:"tag" bson:"tag"`
+}
+
+// Normalize converts a raw tag into its canonical form, returns empty string if nothing is left
+func Normalize(tag string) string {
+	tag = strings.TrimSpace(tag)
+	tag = strings.TrimLeft(tag, "#")
+	tag = strings.ToLower(tag)
+	tag = invalidTagCharacters.ReplaceAllString(tag, "")
+
+	if runes := []rune(tag); len(runes) > MaxTagLength {
+		tag = string(runes[:MaxTagLength])
+	}
+
+	return tag
+}
+
+// NormalizeAll normalizes given tags dropping empty and duplicate ones
+func NormalizeAll(tags []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+
+	for _, tag := range tags {
+		tag = Normalize(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+		seen[tag] = true
+		result = append(result, tag)
+	}
+
+	return result
+}
+
+// RecordUsage increments usage counters of given tags, creating missing ones
+func RecordUsage(ctx context.Context, db *mongo.Database, tags []string) error {
+	return updateUsage(ctx, db, tags, 1)
+}
+
+// ReleaseUsage decrements usage counters of given tags
+func ReleaseUsage(ctx context.Context, db *mongo.Database, tags []string) error {
+	return updateUsage(ctx, db, tags, -1)
+}
+
+func updateUsage(ctx context.Context, db *mongo.Database, tags []string, amount int) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	collection := db.Collection("tags")
+	ctx, cancel := database.Query(ctx)
+
+	defer cancel()
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	models := make([]mongo.WriteModel, len(tags))
+	for i, tag := range tags {
+		set := bson.D{}
+		if amount > 0 {
+			set = append(set, primitive.E{Key: "lastUsed", Value: now})
+		}
+
+		update := bson.D{
+			primitive.E{Key: "$inc", Value: bson.D{primitive.E{Key: "count", Value: amount}}},
+			primitive.E{Key: "$setOnInsert", Value: bson.D{primitive.E{Key: "date", Value: now}}},
+		}
+		if len(set) > 0 {
+			update = append(update, primitive.E{Key: "$set", Value: set})
+		}
+
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.D{primitive.E{Key: "name", Value: tag}}).
+			SetUpdate(update).
+			SetUpsert(amount > 0)
+	}
+
+	_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// Trending fetch tags trending in the recent time window
+func Trending(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+
+		collection := db.Collection("posts")
+		ctx, cancel := database.Query(request.Context())
+
+		defer cancel()
+
+		now := time.Now()
+
+		match := bson.D{
+			primitive.E{
+				Key: "$match",
+				Value: bson.D{
+					primitive.E{Key: "date", Value: bson.D{
+						primitive.E{Key: "$gte", Value: primitive.NewDateTimeFromTime(now.Add(-trendingWindow))},
+					}},
+					primitive.E{Key: "tags.0", Value: bson.D{primitive.E{Key: "$exists", Value: true}}},
+				},
+			},
+		}
+
+		project := bson.D{
+			primitive.E{
+				Key: "$project",
+				Value: bson.D{
+					primitive.E{Key: "tags", Value: "$tags"},
+					primitive.E{Key: "weight", Value: bson.D{
+						primitive.E{Key: "$pow", Value: []interface{}{
+							0.5,
+							bson.D{primitive.E{Key: "$divide", Value: []interface{}{
+								bson.D{primitive.E{Key: "$subtract", Value: []interface{}{
+									primitive.NewDateTimeFromTime(now),
+									"$date",
+								}}},
+								trendingHalfLife.Milliseconds(),
+							}}},
+						}},
+					}},
+				},
+			},
+		}
+
+		unwind := bson.D{
+			primitive.E{
+				Key:   "$unwind",
+				Value: "$tags",
+			},
+		}
+
+		group := bson.D{
+			primitive.E{
+				Key: "$group",
+				Value: bson.D{
+					primitive.E{Key: "_id", Value: "$tags"},
+					primitive.E{Key: "posts", Value: bson.D{primitive.E{Key: "$sum", Value: 1}}},
+					primitive.E{Key: "score", Value: bson.D{primitive.E{Key: "$sum", Value: "$weight"}}},
+				},
+			},
+		}
+
+		sort := bson.D{
+			primitive.E{
+				Key: "$sort",
+				Value: bson.D{primitive.E{
+					Key:   "score",
+					Value: -1,
+				}, primitive.E{
+					Key:   "_id",
+					Value: 1,
+				}},
+			},
+		}
+
+		limit := bson.D{
+			primitive.E{
+				Key:   "$limit",
+				Value: trendingLimit,
+			},
+		}
+
+		opts := database.Aggregate()
+
+		cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+			match,
+			project,
+			unwind,
+			group,
+			sort,
+			limit,
+		}, opts)
+
+		if err != nil {
+			apierror.WriteError(response, request, err)
+			return
+		}
+
+		results := []TrendingTag{}
+		if err = cursor.All(ctx, &results); err != nil {
+			apierror.WriteError(response, request, err)
+			return
+		}
+
+		json.NewEncoder(response).Encode(results)
+	}
+}
+
+// TagAction is for following and unfollowing tags
+func TagAction(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+		actionType := mux.Vars(request)["type"]
+
+		authID, _, ok := request.BasicAuth()
+
+		if ok {
+			oID, _ := primitive.ObjectIDFromHex(authID)
+			var action TagActionModel
+			err := json.NewDecoder(request.Body).Decode(&action)
+
+			if err != nil {
+				apierror.Write(response, request, apierror.InvalidBody)
+				return
+			}
+
+			tag := Normalize(action.Tag)
+			if tag == "" {
+				apierror.Write(response, request, apierror.InvalidTag)
+				return
+			}
+
+			if actionType == "follow" {
+				follow(db, response, request, oID, tag)
+				return
+			} else if actionType == "unfollow" {
+				unfollow(db, response, request, oID, tag)
+				return
+			}
+		}
+
+		apierror.Write(response, request, apierror.NotFound)
+	}
+}
+
+// GetFollowed fetch tags followed by the user
+func GetFollowed(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+
+		authID, _, ok := request.BasicAuth()
+
+		if ok {
+			oID, _ := primitive.ObjectIDFromHex(authID)
+			followed, err := Followed(request.Context(), db, oID)
+			if err != nil {
+				apierror.WriteError(response, request, err)
+				return
+			}
+
+			json.NewEncoder(response).Encode(followed)
+		}
+	}
+}
+
+// Followed returns tags followed by given user
+func Followed(ctx context.Context, db *mongo.Database, userID primitive.ObjectID) ([]string, error) {
+	collection := db.Collection("users")
+	ctx, cancel := database.Query(ctx)
+
+	defer cancel()
+
+	var user struct {
+		Tags []string `bson:"tags"`
+	}
+	opts := options.FindOne().SetProjection(bson.D{primitive.E{Key: "tags", Value: 1}})
+	err := collection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: userID}}, opts).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Tags == nil {
+		return []string{}, nil
+	}
+
+	return user.Tags, nil
+}
+
+// RecordFollows increments follower counters of given tags, creating missing ones
+func RecordFollows(ctx context.Context, db *mongo.Database, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	collection := db.Collection("tags")
+	ctx, cancel := database.Query(ctx)
+
+	defer cancel()
+
+	now := primitive.NewDateTimeFromTime(time.Now())
+	models := make([]mongo.WriteModel, len(tags))
+	for i, tag := range tags {
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.D{primitive.E{Key: "name", Value: tag}}).
+			SetUpdate(bson.D{
+				primitive.E{Key: "$inc", Value: bson.D{primitive.E{Key: "follows", Value: 1}}},
+				primitive.E{Key: "$setOnInsert", Value: bson.D{primitive.E{Key: "date", Value: now}}},
+			}).
+			SetUpsert(true)
+	}
+
+	_, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+func follow(db *mongo.Database, response http.ResponseWriter, request *http.Request, userID primitive.ObjectID, tag string) {
+	usersCollection := db.Collection("users")
+	ctx, cancel := database.Query(request.Context())
+
+	defer cancel()
+
+	filter := bson.D{
+		primitive.E{Key: "_id", Value: userID},
+		primitive.E{Key: "tags", Value: bson.D{primitive.E{Key: "$ne", Value: tag}}},
+	}
+	update := bson.D{primitive.E{
+		Key: "$push", Value: bson.D{primitive.E{Key: "tags", Value: tag}},
+	}}
+	result, err := usersCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		apierror.WriteError(response, request, err)
+		return
+	}
+
+	// Following a followed tag changes nothing and is not an error, like
+	// setting an edge to the state it is already in
+	if result.ModifiedCount > 0 {
+		// The tag is followed, its count must follow even if the client is gone
+		if err = RecordFollows(context.WithoutCancel(ctx), db, []string{tag}); err != nil {
+			logger.FromRequest(request).Error("Failed to record tag follow", "error", err)
+		}
+	}
+
+	response.Write([]byte(`{ "message": "OK" }`))
+}
+
+func unfollow(db *mongo.Database, response http.ResponseWriter, request *http.Request, userID primitive.ObjectID, tag string) {
+	usersCollection := db.Collection("users")
+	tagsCollection := db.Collection("tags")
+	ctx, cancel := database.Query(request.Context())
+
+	defer cancel()
+
+	filter := bson.D{
+		primitive.E{Key: "_id", Value: userID},
+		primitive.E{Key: "tags", Value: tag},
+	}
+	update := bson.D{primitive.E{
+		Key: "$pull", Value: bson.D{primitive.E{Key: "tags", Value: tag}},
+	}}
+	result, err := usersCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		apierror.WriteError(response, request, err)
+		return
+	}
+
+	if result.ModifiedCount > 0 {
+		// The tag is unfollowed, its count must follow even if the client is gone
+		followup, cancelFollowup := database.Query(context.WithoutCancel(ctx))
+
+		defer cancelFollowup()
+
+		_, err = tagsCollection.UpdateOne(
+			followup,
+			bson.D{primitive.E{Key: "name", Value: tag}},
+			bson.D{primitive.E{Key: "$inc", Value: bson.D{primitive.E{Key: "follows", Value: -1}}}},
+		)
+		if err != nil {
+			logger.FromRequest(request).Error("Failed to record tag unfollow", "error", err)
+		}
+	}
+
+	response.Write([]byte(`{ "message": "OK" }`))
+}
+
+// CreateIndexes creates indexes of the tags collection
+func CreateIndexes(db *mongo.Database) error {
+	collection := db.Collection("tags")
+	postsCollection := db.Collection("posts")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{primitive.E{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = postsCollection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{primitive.E{Key: "tags", Value: 1}, primitive.E{Key: "date", Value: -1}},
+	})
+	return err
+}
@@ -0,0 +1,319 @@
+package timeline
+
+import (
+	"context"
+	"jt-api/database"
+	"jt-api/edges"
+	"jt-api/pagination"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Authors with at least PopularThreshold followers are not fanned out on
+// write, their posts are merged into personal feeds when they are read
+const PopularThreshold = 10000
+
+// backfillLimit is the number of recent posts copied on a new follow
+const backfillLimit = 100
+
+// Entry is a post placed on a user's timeline
+type Entry struct {
+	ID     primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Owner  primitive.ObjectID `json:"owner" bson:"owner"`
+	Post   primitive.ObjectID `json:"post" bson:"post"`
+	Author primitive.ObjectID `json:"author" bson:"author"`
+	Date   primitive.DateTime `json:"date" bson:"date"`
+}
+
+// FanOut places a new post on the timelines of its author and the author's followers
+func FanOut(ctx context.Context, db *mongo.Database, postID primitive.ObjectID, authorID primitive.ObjectID, date primitive.DateTime) error {
+	usersCollection := db.Collection("users")
+	collection := db.Collection("timelines")
+	ctx, cancel := database.Batch(ctx)
+
+	defer cancel()
+
+	var author struct {
+		Popular bool `bson:"popular"`
+	}
+	opts := options.FindOne().SetProjection(bson.D{primitive.E{Key: "popular", Value: 1}})
+	err := usersCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: authorID}}, opts).Decode(&author)
+	if err != nil {
+		return err
+	}
+
+	owners := []primitive.ObjectID{authorID}
+	if !author.Popular {
+		followers, err := edges.Sources(ctx, db, edges.Follow, authorID)
+		if err != nil {
+			return err
+		}
+		owners = append(owners, followers...)
+	}
+
+	entries := make([]interface{}, len(owners))
+	for i, owner := range owners {
+		entries[i] = Entry{Owner: owner, Post: postID, Author: authorID, Date: date}
+	}
+
+	_, err = collection.InsertMany(ctx, entries, options.InsertMany().SetOrdered(false))
+	if mongo.IsDuplicateKeyError(err) {
+		return nil
+	}
+	return err
+}
+
+// Backfill copies recent posts of followee to follower's timeline
+func Backfill(ctx context.Context, db *mongo.Database, followerID primitive.ObjectID, followeeID primitive.ObjectID) error {
+	usersCollection := db.Collection("users")
+	postsCollection := db.Collection("posts")
+	collection := db.Collection("timelines")
+	ctx, cancel := database.Batch(ctx)
+
+	defer cancel()
+
+	var followee struct {
+		Popular bool `bson:"popular"`
+	}
+	opts := options.FindOne().SetProjection(bson.D{primitive.E{Key: "popular", Value: 1}})
+	err := usersCollection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: followeeID}}, opts).Decode(&followee)
+	if err != nil || followee.Popular {
+		return err
+	}
+
+	findOpts := options.Find().
+		SetProjection(bson.D{primitive.E{Key: "_id", Value: 1}, primitive.E{Key: "date", Value: 1}}).
+		SetSort(bson.D{primitive.E{Key: "date", Value: -1}}).
+		SetLimit(backfillLimit)
+	cursor, err := postsCollection.Find(ctx, bson.D{primitive.E{Key: "author", Value: followeeID}}, findOpts)
+	if err != nil {
+		return err
+	}
+
+	var posts []struct {
+		ID   primitive.ObjectID `bson:"_id"`
+		Date primitive.DateTime `bson:"date"`
+	}
+	if err = cursor.All(ctx, &posts); err != nil {
+		return err
+	}
+
+	if len(posts) == 0 {
+		return nil
+	}
+
+	models := make([]mongo.WriteModel, len(posts))
+	for i, post := range posts {
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.D{
+				primitive.E{Key: "owner", Value: followerID},
+				primitive.E{Key: "post", Value: post.ID},
+			}).
+			SetUpdate(bson.D{primitive.E{Key: "$setOnInsert", Value: Entry{
+				Owner:  followerID,
+				Post:   post.ID,
+				Author: followeeID,
+				Date:   post.Date,
+			}}}).
+			SetUpsert(true)
+	}
+
+	_, err = collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	return err
+}
+
+// rebuilding holds the owners whose timelines are being rebuilt
+var rebuilding sync.Map
+
+// Rebuild backfills owner's timeline from every user they follow, used once
+// for users who followed others before timelines existed
+//
+// Every followee is backfilled within its own deadline so long follow lists
+// do not time out, a rebuild of a timeline already being rebuilt returns at
+// once
+func Rebuild(ctx context.Context, db *mongo.Database, ownerID primitive.ObjectID) error {
+	if _, running := rebuilding.LoadOrStore(ownerID, true); running {
+		return nil
+	}
+
+	defer rebuilding.Delete(ownerID)
+
+	follows, err := edges.Targets(ctx, db, edges.Follow, ownerID)
+	if err != nil {
+		return err
+	}
+
+	for _, followeeID := range append(follows, ownerID) {
+		if err = Backfill(ctx, db, ownerID, followeeID); err != nil {
+			return err
+		}
+	}
+
+	collection := db.Collection("users")
+	ctx, cancel := database.Query(ctx)
+
+	defer cancel()
+
+	_, err = collection.UpdateOne(
+		ctx,
+		bson.D{primitive.E{Key: "_id", Value: ownerID}},
+		bson.D{primitive.E{Key: "$set", Value: bson.D{primitive.E{Key: "timelineReady", Value: true}}}},
+	)
+	return err
+}
+
+// RemoveAuthor removes posts of given author from owner's timeline, used on unfollow
+func RemoveAuthor(ctx context.Context, db *mongo.Database, ownerID primitive.ObjectID, authorID primitive.ObjectID) error {
+	collection := db.Collection("timelines")
+	ctx, cancel := database.Batch(ctx)
+
+	defer cancel()
+
+	_, err := collection.DeleteMany(ctx, bson.D{
+		primitive.E{Key: "owner", Value: ownerID},
+		primitive.E{Key: "author", Value: authorID},
+	})
+	return err
+}
+
+// RemovePost removes given post from every timeline
+func RemovePost(ctx context.Context, db *mongo.Database, postID primitive.ObjectID) error {
+	collection := db.Collection("timelines")
+	ctx, cancel := database.Batch(ctx)
+
+	defer cancel()
+
+	_, err := collection.DeleteMany(ctx, bson.D{primitive.E{Key: "post", Value: postID}})
+	return err
+}
+
+// PostIDs returns IDs of the timeline posts that may appear on given page of a
+// date sorted feed
+//
+// The result is a superset of the page, it still has to be merged with the
+// other sources of the feed and sliced by the page stages
+func PostIDs(ctx context.Context, db *mongo.Database, ownerID primitive.ObjectID, page pagination.Page) ([]primitive.ObjectID, error) {
+	collection := db.Collection("timelines")
+	ctx, cancel := database.Query(ctx)
+
+	defer cancel()
+
+	filter := bson.D{primitive.E{Key: "owner", Value: ownerID}}
+	limit := int64(page.Limit + 1)
+
+	if page.Legacy() {
+		limit = int64(page.Number * page.Limit)
+	} else if page.Cursor != nil {
+		filter = append(filter, primitive.E{Key: "$or", Value: []interface{}{
+			bson.D{primitive.E{Key: "date", Value: bson.D{primitive.E{Key: "$lt", Value: page.Cursor.Values[0]}}}},
+			bson.D{
+				primitive.E{Key: "date", Value: page.Cursor.Values[0]},
+				primitive.E{Key: "post", Value: bson.D{primitive.E{Key: "$lt", Value: page.Cursor.ID}}},
+			},
+		}})
+	}
+
+	opts := options.Find().
+		SetProjection(bson.D{primitive.E{Key: "post", Value: 1}}).
+		SetSort(bson.D{primitive.E{Key: "date", Value: -1}, primitive.E{Key: "post", Value: -1}}).
+		SetLimit(limit)
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	if err = cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.Post
+	}
+
+	return ids, nil
+}
+
+// PopularFollowees returns popular authors followed by given user
+func PopularFollowees(ctx context.Context, db *mongo.Database, userID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	collection := db.Collection("users")
+	ctx, cancel := database.Query(ctx)
+
+	defer cancel()
+
+	follows, err := edges.Targets(ctx, db, edges.Follow, userID)
+	if err != nil || len(follows) == 0 {
+		return nil, err
+	}
+
+	opts := options.Find().SetProjection(bson.D{primitive.E{Key: "_id", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.D{
+		primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: "$in", Value: follows}}},
+		primitive.E{Key: "popular", Value: true},
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	if err = cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+
+	ids := make([]primitive.ObjectID, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
+
+	return ids, nil
+}
+
+// UpdatePopularity flags or unflags given user as popular by their follower count
+func UpdatePopularity(ctx context.Context, db *mongo.Database, userID primitive.ObjectID) error {
+	collection := db.Collection("users")
+	ctx, cancel := database.Query(ctx)
+
+	defer cancel()
+
+	update := mongo.Pipeline{
+		bson.D{primitive.E{Key: "$set", Value: bson.D{
+			primitive.E{Key: "popular", Value: bson.D{primitive.E{Key: "$gte", Value: []interface{}{
+				bson.D{primitive.E{Key: "$ifNull", Value: []interface{}{"$followerCount", 0}}},
+				PopularThreshold,
+			}}}},
+		}}},
+	}
+	_, err := collection.UpdateOne(ctx, bson.D{primitive.E{Key: "_id", Value: userID}}, update)
+	return err
+}
+
+// CreateIndexes creates indexes of the timelines collection
+func CreateIndexes(db *mongo.Database) error {
+	collection := db.Collection("timelines")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{primitive.E{Key: "owner", Value: 1}, primitive.E{Key: "post", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{
+			primitive.E{Key: "owner", Value: 1},
+			primitive.E{Key: "date", Value: -1},
+			primitive.E{Key: "post", Value: -1},
+		}},
+		{Keys: bson.D{primitive.E{Key: "owner", Value: 1}, primitive.E{Key: "author", Value: 1}}},
+		{Keys: bson.D{primitive.E{Key: "post", Value: 1}}},
+	})
+	return err
+}
@@ -2,9 +2,14 @@ package upload
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"image"
 	"image/jpeg"
+	"jt-api/apierror"
+	"jt-api/config"
+	"jt-api/metrics"
+	"jt-api/tracing"
 
 	// Decode jpg images
 	_ "image/jpeg"
@@ -12,16 +17,17 @@ import (
 	// Decode png images
 	_ "image/png"
 	"net/http"
-	"os"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/nfnt/resize"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // ImageUpload uploaded image model response
@@ -29,15 +35,28 @@ type ImageUpload struct {
 	Path string `json:"path" bson:"path"`
 }
 
+func newSession() *session.Session {
+	return session.Must(session.NewSession(&aws.Config{
+		Region: aws.String("eu-central-1"),
+	}))
+}
+
+// Check tells if the bucket of uploaded images is reachable
+func Check(ctx context.Context, conf config.Server) error {
+	_, err := s3.New(newSession()).HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(conf.AWSBucket),
+	})
+	return err
+}
+
 // Image upload file to aws s3 bucket
-func Image(db *mongo.Client, heightIndex int) func(response http.ResponseWriter, request *http.Request) {
+func Image(db *mongo.Database, conf config.Server, heightIndex int) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 
 		file, header, err := request.FormFile("image")
 		if err != nil {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.Write(response, request, apierror.InvalidImage)
 			return
 		}
 
@@ -45,8 +64,7 @@ func Image(db *mongo.Client, heightIndex int) func(response http.ResponseWriter,
 
 		rawImage, _, err := image.Decode(file)
 		if err != nil {
-			response.WriteHeader(http.StatusInternalServerError)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.Write(response, request, apierror.InvalidImage)
 			return
 		}
 
@@ -63,29 +81,27 @@ func Image(db *mongo.Client, heightIndex int) func(response http.ResponseWriter,
 		buffer := new(bytes.Buffer)
 		err = jpeg.Encode(buffer, resizedImage, nil)
 		if err != nil {
-			response.WriteHeader(http.StatusInternalServerError)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.WriteError(response, request, err)
 			return
 		}
 
-		sess := session.Must(session.NewSession(&aws.Config{
-			Region: aws.String("eu-central-1"),
-		}))
-
-		uploader := s3manager.NewUploader(sess)
+		uploader := s3manager.NewUploader(newSession())
 		extension := strings.Split(header.Header.Get("Content-Type"), "/")[1]
 		r := regexp.MustCompile(`[\s+=.:-]`)
 		name := r.ReplaceAllString(header.Filename+time.Now().String(), "") + "." + extension
 
-		result, err := uploader.Upload(&s3manager.UploadInput{
+		ctx, span := tracing.Start(request.Context(), "s3.upload", attribute.Int("size", buffer.Len()))
+		start := time.Now()
+		result, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
 			ACL:    aws.String("public-read"),
-			Bucket: aws.String(os.Getenv("AWS_BUCKET")),
+			Bucket: aws.String(conf.AWSBucket),
 			Key:    aws.String(name),
 			Body:   bytes.NewReader(buffer.Bytes()),
 		})
+		metrics.Upload(buffer.Len(), start, err)
+		tracing.End(span, err)
 		if err != nil {
-			response.WriteHeader(http.StatusInternalServerError)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.WriteError(response, request, err)
 			return
 		}
 
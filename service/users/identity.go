@@ -0,0 +1,277 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"jt-api/apierror"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Usernames and emails are unique regardless of case, they are stored as given
+// for display and in canonical form in usernameLower and emailLower for lookups
+
+// Canonical returns the form of a username or email used for lookups
+func Canonical(identifier string) string {
+	return strings.ToLower(strings.TrimSpace(identifier))
+}
+
+// IdentifierFilter returns the filter matching the user with given username
+// or email, usernames can not contain @ so the two do not overlap
+func IdentifierFilter(identifier string) bson.D {
+	if strings.Contains(identifier, "@") {
+		return EmailFilter(identifier)
+	}
+	return UsernameFilter(identifier)
+}
+
+// UsernameFilter returns the filter matching the user with given username
+// regardless of case
+func UsernameFilter(username string) bson.D {
+	return canonicalFilter("username", username)
+}
+
+// EmailFilter returns the filter matching the user with given email
+// regardless of case
+func EmailFilter(email string) bson.D {
+	return canonicalFilter("email", email)
+}
+
+// canonicalFilter matches value in the canonical form of field. Users the
+// identifier migration has not reached yet have no canonical form, they are
+// matched by the exact value until it has run
+func canonicalFilter(field string, value string) bson.D {
+	return bson.D{primitive.E{Key: "$or", Value: []interface{}{
+		bson.D{primitive.E{Key: field + "Lower", Value: Canonical(value)}},
+		bson.D{
+			primitive.E{Key: field + "Lower", Value: bson.D{primitive.E{Key: "$exists", Value: false}}},
+			primitive.E{Key: field, Value: strings.TrimSpace(value)},
+		},
+	}}}
+}
+
+// unmigratedConflict returns the error to respond when a user other than
+// except, that the identifier migration has not reached yet, has username or
+// email regardless of case, nil otherwise. The unique indexes only cover
+// canonical forms, without the check a new user could take the identifier of
+// such a user and logins would match both. Empty values are not checked
+func unmigratedConflict(ctx context.Context, collection *mongo.Collection, except primitive.ObjectID, username string, email string) error {
+	if username != "" {
+		taken, err := unmigratedTaken(ctx, collection, except, "username", username)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return apierror.New(apierror.UsernameTaken)
+		}
+	}
+	if email != "" {
+		taken, err := unmigratedTaken(ctx, collection, except, "email", email)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return apierror.New(apierror.EmailTaken)
+		}
+	}
+	return nil
+}
+
+func unmigratedTaken(ctx context.Context, collection *mongo.Collection, except primitive.ObjectID, field string, value string) (bool, error) {
+	filter := bson.D{
+		primitive.E{Key: "_id", Value: bson.D{primitive.E{Key: "$ne", Value: except}}},
+		primitive.E{Key: field + "Lower", Value: bson.D{primitive.E{Key: "$exists", Value: false}}},
+		primitive.E{Key: field, Value: primitive.Regex{
+			Pattern: "^" + regexp.QuoteMeta(strings.TrimSpace(value)) + "$",
+			Options: "i",
+		}},
+	}
+	opts := options.FindOne().SetProjection(bson.D{primitive.E{Key: "_id", Value: 1}})
+
+	err := collection.FindOne(ctx, filter, opts).Err()
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// takenError returns the error to respond when err violates the unique index
+// of usernames or emails, nil for any other error
+func takenError(err error) error {
+	var message string
+
+	var writeErr mongo.WriteException
+	var commandErr mongo.CommandError
+	switch {
+	case errors.As(err, &writeErr):
+		for _, each := range writeErr.WriteErrors {
+			if each.Code == 11000 {
+				message = each.Message
+			}
+		}
+	case errors.As(err, &commandErr) && commandErr.HasErrorCode(11000):
+		message = commandErr.Message
+	}
+
+	switch {
+	case strings.Contains(message, "usernameLower"):
+		return apierror.New(apierror.UsernameTaken)
+	case strings.Contains(message, "emailLower"):
+		return apierror.New(apierror.EmailTaken)
+	}
+	return nil
+}
+
+// CreateIndexes creates the unique indexes of canonical usernames and emails,
+// users that are not migrated yet have neither and are left out
+func CreateIndexes(db *mongo.Database) error {
+	collection := db.Collection("users")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{primitive.E{Key: "usernameLower", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.D{
+				primitive.E{Key: "usernameLower", Value: bson.D{primitive.E{Key: "$exists", Value: true}}},
+			}),
+		},
+		{
+			Keys: bson.D{primitive.E{Key: "emailLower", Value: 1}},
+			Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.D{
+				primitive.E{Key: "emailLower", Value: bson.D{primitive.E{Key: "$exists", Value: true}}},
+			}),
+		},
+	})
+	return err
+}
+
+// Collision is a user whose username or email is taken by another user in a
+// different case, the user keeps logging in with the exact value until one
+// of them is renamed and the migration runs again
+type Collision struct {
+	User      primitive.ObjectID
+	Field     string
+	Value     string
+	Canonical string
+}
+
+// migrationBatch is the number of updates sent to the database at once
+const migrationBatch = 500
+
+// MigrateIdentifiers fills canonical usernames and emails of users missing
+// them and returns how many were filled. Values are lowercased here with
+// Canonical rather than by the database, which only lowercases ASCII
+//
+// A value taken by another user in a different case is skipped and returned
+// as a collision, the rest of the users are migrated anyway
+func MigrateIdentifiers(db *mongo.Database) (int, []Collision, error) {
+	if err := CreateIndexes(db); err != nil {
+		return 0, nil, err
+	}
+
+	collection := db.Collection("users")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+
+	defer cancel()
+
+	filter := bson.D{primitive.E{Key: "$or", Value: []interface{}{
+		bson.D{primitive.E{Key: "usernameLower", Value: bson.D{primitive.E{Key: "$exists", Value: false}}}},
+		bson.D{primitive.E{Key: "emailLower", Value: bson.D{primitive.E{Key: "$exists", Value: false}}}},
+	}}}
+	opts := options.Find().SetProjection(bson.D{
+		primitive.E{Key: "username", Value: 1},
+		primitive.E{Key: "email", Value: 1},
+		primitive.E{Key: "usernameLower", Value: 1},
+		primitive.E{Key: "emailLower", Value: 1},
+	})
+
+	cursor, err := collection.Find(ctx, filter, opts)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer cursor.Close(ctx)
+
+	migrated := 0
+	var collisions []Collision
+	var pending []Collision
+	flush := func() error {
+		filled, found, err := fillCanonical(ctx, collection, pending)
+		migrated += filled
+		collisions = append(collisions, found...)
+		pending = pending[:0]
+		return err
+	}
+
+	for cursor.Next(ctx) {
+		var user User
+		if err = cursor.Decode(&user); err != nil {
+			return migrated, collisions, err
+		}
+
+		if user.UsernameLower == "" && user.Username != "" {
+			pending = append(pending, Collision{User: user.ID, Field: "username", Value: user.Username, Canonical: Canonical(user.Username)})
+		}
+		if user.EmailLower == "" && user.Email != "" {
+			pending = append(pending, Collision{User: user.ID, Field: "email", Value: user.Email, Canonical: Canonical(user.Email)})
+		}
+
+		if len(pending) >= migrationBatch {
+			if err = flush(); err != nil {
+				return migrated, collisions, err
+			}
+		}
+	}
+	if err = cursor.Err(); err != nil {
+		return migrated, collisions, err
+	}
+
+	err = flush()
+	return migrated, collisions, err
+}
+
+// fillCanonical sets the canonical values of updates, updates violating the
+// unique indexes are returned as collisions
+func fillCanonical(ctx context.Context, collection *mongo.Collection, updates []Collision) (int, []Collision, error) {
+	if len(updates) == 0 {
+		return 0, nil, nil
+	}
+
+	models := make([]mongo.WriteModel, len(updates))
+	for i, update := range updates {
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.D{
+				primitive.E{Key: "_id", Value: update.User},
+				primitive.E{Key: update.Field + "Lower", Value: bson.D{primitive.E{Key: "$exists", Value: false}}},
+			}).
+			SetUpdate(bson.D{primitive.E{Key: "$set", Value: bson.D{
+				primitive.E{Key: update.Field + "Lower", Value: update.Canonical},
+			}}})
+	}
+
+	result, err := collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+		var collisions []Collision
+		for _, writeErr := range bulkErr.WriteErrors {
+			if writeErr.Code != 11000 {
+				return 0, nil, err
+			}
+			collisions = append(collisions, updates[writeErr.Index])
+		}
+		return int(result.ModifiedCount), collisions, nil
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return int(result.ModifiedCount), nil, nil
+}
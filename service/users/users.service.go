@@ -3,12 +3,21 @@ package users
 import (
 	"context"
 	"encoding/json"
+	"jt-api/apierror"
+	"jt-api/background"
 	"jt-api/config"
+	"jt-api/database"
+	"jt-api/edges"
+	"jt-api/logger"
+	"jt-api/mail"
+	"jt-api/pagination"
 	"jt-api/service/notification"
-	"log"
+	"jt-api/service/tags"
+	"jt-api/service/timeline"
+	"jt-api/service/verification"
+	"jt-api/validation"
+	"log/slog"
 	"net/http"
-	"os"
-	"time"
 
 	"firebase.google.com/go/messaging"
 	"golang.org/x/crypto/bcrypt"
@@ -22,32 +31,37 @@ import (
 
 // User is Common user model for database
 type User struct {
-	ID            primitive.ObjectID    `json:"_id,omitempty" bson:"_id,omitempty"`
-	Fullname      string                `json:"fullname,omitempty" bson:"fullname,omitempty"`
-	Username      string                `json:"username,omitempty" bson:"username,omitempty"`
-	Email         string                `json:"email,omitempty" bson:"email,omitempty"`
-	Password      string                `json:"password,omitempty" bson:"password,omitempty"`
-	Image         string                `json:"image,omitempty" bson:"image,omitempty"`
-	Bio           string                `json:"bio" bson:"bio"`
-	Language      string                `json:"language,omitempty" bson:"language,omitempty"`
-	Verified      bool                  `json:"verified" bson:"verified"`
-	FCMToken      string                `json:"fcmtoken,omitempty" bson:"fcmtoken,omitempty"`
-	Rank          int                   `json:"rank" bson:"rank"`
-	Type          int                   `json:"type" bson:"type"`
-	Followers     *[]primitive.ObjectID `json:"followers,omitempty" bson:"followers,omitempty"`
-	Follows       *[]primitive.ObjectID `json:"follows,omitempty" bson:"follows,omitempty"`
-	Communities   *[]primitive.ObjectID `json:"communities,omitempty" bson:"communities,omitempty"`
-	Notifications *[]interface{}        `json:"notifications,omitempty" bson:"notifications,omitempty"`
+	ID            primitive.ObjectID `json:"_id,omitempty" bson:"_id,omitempty"`
+	Fullname      string             `json:"fullname,omitempty" bson:"fullname,omitempty" validate:"required,max=50"`
+	Username      string             `json:"username,omitempty" bson:"username,omitempty" validate:"required,min=3,max=20,username"`
+	Email         string             `json:"email,omitempty" bson:"email,omitempty" validate:"required,max=254,email"`
+	UsernameLower string             `json:"-" bson:"usernameLower,omitempty"`
+	EmailLower    string             `json:"-" bson:"emailLower,omitempty"`
+	Password      string             `json:"password,omitempty" bson:"password,omitempty" validate:"required,password"`
+	Image         string             `json:"image,omitempty" bson:"image,omitempty"`
+	Bio           string             `json:"bio" bson:"bio" validate:"max=160"`
+	Language      string             `json:"language,omitempty" bson:"language,omitempty"`
+	Verified      bool               `json:"verified" bson:"verified"`
+	EmailVerified bool               `json:"emailVerified" bson:"emailVerified"`
+	FCMToken      string             `json:"fcmtoken,omitempty" bson:"fcmtoken,omitempty"`
+	Rank          int                `json:"rank" bson:"rank"`
+	Type          int                `json:"type" bson:"type"`
+	Tags          *[]string          `json:"tags,omitempty" bson:"tags,omitempty" validate:"max=30"`
+	Popular       bool               `json:"popular" bson:"popular"`
+	TimelineReady bool               `json:"timelineReady" bson:"timelineReady"`
+	FollowerCount int                `json:"followerCount" bson:"followerCount"`
+	FollowCount   int                `json:"followCount" bson:"followCount"`
+	Notifications *[]interface{}     `json:"notifications,omitempty" bson:"notifications,omitempty"`
 }
 
 // UserUpdate is model for user edits
 type UserUpdate struct {
-	Fullname string `json:"fullname,omitempty" bson:"fullname,omitempty"`
-	Username string `json:"username,omitempty" bson:"username,omitempty"`
-	Email    string `json:"email,omitempty" bson:"email,omitempty"`
-	Password string `json:"password,omitempty" bson:"password,omitempty"`
+	Fullname string `json:"fullname,omitempty" bson:"fullname,omitempty" validate:"max=50"`
+	Username string `json:"username,omitempty" bson:"username,omitempty" validate:"min=3,max=20,username"`
+	Email    string `json:"email,omitempty" bson:"email,omitempty" validate:"max=254,email"`
+	Password string `json:"password,omitempty" bson:"password,omitempty" validate:"password"`
 	Image    string `json:"image,omitempty" bson:"image,omitempty"`
-	Bio      string `json:"bio,omitempty" bson:"bio,omitempty"`
+	Bio      string `json:"bio,omitempty" bson:"bio,omitempty" validate:"max=160"`
 }
 
 // TokenUpdate is model for updating fcm token
@@ -61,22 +75,21 @@ type UserActionModel struct {
 }
 
 // GetUser fetch single user from database
-func GetUser(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func GetUser(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 		params := mux.Vars(request)
 		id, err := primitive.ObjectIDFromHex(params["id"])
 		if err != nil {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.Write(response, request, apierror.InvalidID)
 			return
 		}
 
 		authID, _, ok := request.BasicAuth()
 
 		if ok {
-			collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			collection := db.Collection("users")
+			ctx, cancel := database.Query(request.Context())
 
 			defer cancel()
 
@@ -97,37 +110,30 @@ func GetUser(db *mongo.Client) func(response http.ResponseWriter, request *http.
 						primitive.E{Key: "image", Value: "$image"},
 						primitive.E{Key: "bio", Value: "$bio"},
 						primitive.E{Key: "verified", Value: "$verified"},
-						primitive.E{Key: "followed", Value: bson.D{
-							primitive.E{Key: "$in", Value: []interface{}{oID, "$followers"}},
-						}},
-						primitive.E{Key: "followers", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$followers"},
-						}},
-						primitive.E{Key: "follows", Value: bson.D{
-							primitive.E{Key: "$size", Value: "$follows"},
-						}},
+						primitive.E{Key: "followers", Value: "$followerCount"},
+						primitive.E{Key: "follows", Value: "$followCount"},
 					},
 				},
 			}
-			opts := options.Aggregate().SetMaxTime(2 * time.Second)
+			opts := database.Aggregate()
 
-			cursor, err := collection.Aggregate(ctx, mongo.Pipeline{match, project}, opts)
+			pipeline := append(mongo.Pipeline{match, project}, edges.Flag(edges.Follow, oID, "followed")...)
+			cursor, err := collection.Aggregate(ctx, pipeline, opts)
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.WriteError(response, request, err)
 				return
 			}
 
 			var results []bson.M
-			if err = cursor.All(context.TODO(), &results); err != nil {
-				log.Fatal(err)
+			if err = cursor.All(ctx, &results); err != nil {
+				apierror.WriteError(response, request, err)
+				return
 			}
 
 			if len(results) > 0 {
 				json.NewEncoder(response).Encode(results[0])
 			} else {
-				response.WriteHeader(http.StatusNotFound)
-				response.Write([]byte(`{ "message": "Not Found" }`))
+				apierror.Write(response, request, apierror.NotFound)
 				return
 			}
 		}
@@ -135,33 +141,53 @@ func GetUser(db *mongo.Client) func(response http.ResponseWriter, request *http.
 }
 
 // CreateUser create user and register to database
-func CreateUser(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func CreateUser(db *mongo.Database, conf config.Server, sender mail.Sender) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 
-		collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		collection := db.Collection("users")
+		ctx, cancel := database.Query(request.Context())
 
 		defer cancel()
 
 		var user User
-		json.NewDecoder(request.Body).Decode(&user)
+		if err := json.NewDecoder(request.Body).Decode(&user); err != nil {
+			apierror.Write(response, request, apierror.InvalidBody)
+			return
+		}
+		if err := validation.Struct(user); err != nil {
+			apierror.WriteError(response, request, err)
+			return
+		}
 
+		if err := unmigratedConflict(ctx, collection, primitive.NilObjectID, user.Username, user.Email); err != nil {
+			apierror.WriteError(response, request, err)
+			return
+		}
+
+		user.UsernameLower = Canonical(user.Username)
+		user.EmailLower = Canonical(user.Email)
 		user.Image = "https://justhink.s3.eu-central-1.amazonaws.com/default-user.png"
 		user.Verified = false
+		user.EmailVerified = false
 		user.Bio = ""
 		user.Rank = 0
 		user.Type = 0
-		user.Followers = &[]primitive.ObjectID{}
-		user.Follows = &[]primitive.ObjectID{}
-		user.Communities = &[]primitive.ObjectID{}
+		user.FollowerCount = 0
+		user.FollowCount = 0
+		if user.Tags == nil {
+			user.Tags = &[]string{}
+		}
+		followedTags := tags.NormalizeAll(*user.Tags)
+		user.Tags = &followedTags
 		user.Notifications = &[]interface{}{}
 		user.Language = "tr"
+		user.Popular = false
+		user.TimelineReady = true
 
 		hash, err := bcrypt.GenerateFromPassword([]byte(user.Password), 5)
 		if err != nil {
-			response.WriteHeader(http.StatusInternalServerError)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.WriteError(response, request, err)
 			return
 		}
 
@@ -169,22 +195,38 @@ func CreateUser(db *mongo.Client) func(response http.ResponseWriter, request *ht
 
 		result, err := collection.InsertOne(ctx, user)
 		if err != nil {
-			response.WriteHeader(http.StatusInternalServerError)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			if taken := takenError(err); taken != nil {
+				err = taken
+			}
+			apierror.WriteError(response, request, err)
 			return
 		}
 
+		if err = tags.RecordFollows(context.WithoutCancel(ctx), db, *user.Tags); err != nil {
+			logger.FromRequest(request).Error("Failed to record tag follows", "error", err)
+		}
+
+		recipient := verification.Recipient{
+			ID:         result.InsertedID.(primitive.ObjectID),
+			Email:      user.Email,
+			EmailLower: user.EmailLower,
+			Language:   user.Language,
+		}
+		sendVerification(context.WithoutCancel(ctx), sender, conf, recipient, logger.FromRequest(request))
+
 		json.NewEncoder(response).Encode(result)
 	}
 }
 
 // EditUser edit user and register to database
-func EditUser(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+//
+// Changing the email makes it unverified until the new one is verified
+func EditUser(db *mongo.Database, conf config.Server, sender mail.Sender) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 
-		collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		collection := db.Collection("users")
+		ctx, cancel := database.Query(request.Context())
 
 		defer cancel()
 
@@ -195,8 +237,16 @@ func EditUser(db *mongo.Client) func(response http.ResponseWriter, request *http
 			id, _ := primitive.ObjectIDFromHex(authID)
 
 			if err != nil {
-				response.WriteHeader(http.StatusBadRequest)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.Write(response, request, apierror.InvalidBody)
+				return
+			}
+			if err = validation.Struct(updateObject); err != nil {
+				apierror.WriteError(response, request, err)
+				return
+			}
+
+			if err = unmigratedConflict(ctx, collection, id, updateObject.Username, updateObject.Email); err != nil {
+				apierror.WriteError(response, request, err)
 				return
 			}
 
@@ -207,9 +257,24 @@ func EditUser(db *mongo.Client) func(response http.ResponseWriter, request *http
 			}
 			if updateObject.Username != "" {
 				updateValue = append(updateValue, primitive.E{Key: "username", Value: updateObject.Username})
+				updateValue = append(updateValue, primitive.E{Key: "usernameLower", Value: Canonical(updateObject.Username)})
 			}
+			emailChanged := false
 			if updateObject.Email != "" {
+				var current User
+				opts := options.FindOne().SetProjection(bson.D{primitive.E{Key: "emailLower", Value: 1}})
+				err = collection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}}, opts).Decode(&current)
+				if err != nil && err != mongo.ErrNoDocuments {
+					apierror.WriteError(response, request, err)
+					return
+				}
+				emailChanged = current.EmailLower != Canonical(updateObject.Email)
+
 				updateValue = append(updateValue, primitive.E{Key: "email", Value: updateObject.Email})
+				updateValue = append(updateValue, primitive.E{Key: "emailLower", Value: Canonical(updateObject.Email)})
+				if emailChanged {
+					updateValue = append(updateValue, primitive.E{Key: "emailVerified", Value: false})
+				}
 			}
 			if updateObject.Image != "" {
 				updateValue = append(updateValue, primitive.E{Key: "image", Value: updateObject.Image})
@@ -220,36 +285,54 @@ func EditUser(db *mongo.Client) func(response http.ResponseWriter, request *http
 			if updateObject.Password != "" {
 				hash, err := bcrypt.GenerateFromPassword([]byte(updateObject.Password), 5)
 				if err != nil {
-					response.WriteHeader(http.StatusInternalServerError)
-					response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+					apierror.WriteError(response, request, err)
 					return
 				}
 				updateValue = append(updateValue, primitive.E{Key: "password", Value: string(hash)})
 			}
 
-			opts := options.FindOneAndUpdate().SetUpsert(true)
+			if len(updateValue) == 0 {
+				apierror.Write(response, request, apierror.InvalidBody)
+				return
+			}
+
 			filter := bson.D{primitive.E{Key: "_id", Value: id}}
 			update := bson.D{primitive.E{Key: "$set", Value: updateValue}}
 			var updatedDocument bson.M
-			err = collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updatedDocument)
+			err = collection.FindOneAndUpdate(ctx, filter, update).Decode(&updatedDocument)
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				if err == mongo.ErrNoDocuments {
+					err = apierror.New(apierror.UserNotFound)
+				} else if taken := takenError(err); taken != nil {
+					err = taken
+				}
+				apierror.WriteError(response, request, err)
 				return
 			}
 
+			if emailChanged {
+				language, _ := updatedDocument["language"].(string)
+				recipient := verification.Recipient{
+					ID:         id,
+					Email:      updateObject.Email,
+					EmailLower: Canonical(updateObject.Email),
+					Language:   language,
+				}
+				sendVerification(context.WithoutCancel(ctx), sender, conf, recipient, logger.FromRequest(request))
+			}
+
 			response.Write([]byte(`{ "message": "OK" }`))
 		}
 	}
 }
 
 // UpdateFCMToken updates firebase cloud messaging token at each login
-func UpdateFCMToken(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func UpdateFCMToken(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 
-		collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		collection := db.Collection("users")
+		ctx, cancel := database.Query(request.Context())
 
 		defer cancel()
 
@@ -260,27 +343,26 @@ func UpdateFCMToken(db *mongo.Client) func(response http.ResponseWriter, request
 			var updateObject TokenUpdate
 			err := json.NewDecoder(request.Body).Decode(&updateObject)
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.Write(response, request, apierror.InvalidBody)
 				return
 			}
 
 			if updateObject.Token == "" {
-				response.WriteHeader(http.StatusBadRequest)
-				response.Write([]byte(`{ "message": "Token not provided" }`))
+				apierror.Write(response, request, apierror.MissingFields)
 				return
 			}
 
-			opts := options.FindOneAndUpdate().SetUpsert(true)
 			filter := bson.D{primitive.E{Key: "_id", Value: id}}
 			update := bson.D{primitive.E{
 				Key: "$set", Value: bson.D{primitive.E{Key: "FCMToken", Value: updateObject.Token}},
 			}}
 			var updatedDocument bson.M
-			err = collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&updatedDocument)
+			err = collection.FindOneAndUpdate(ctx, filter, update).Decode(&updatedDocument)
 			if err != nil {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				if err == mongo.ErrNoDocuments {
+					err = apierror.New(apierror.UserNotFound)
+				}
+				apierror.WriteError(response, request, err)
 				return
 			}
 
@@ -289,14 +371,29 @@ func UpdateFCMToken(db *mongo.Client) func(response http.ResponseWriter, request
 	}
 }
 
-// UserExists find if user exists based on username or email
-func UserExists(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+// sendVerification mails recipient a verification link in the background, a
+// failed mail is only logged since the user can ask for another
+func sendVerification(ctx context.Context, sender mail.Sender, conf config.Server, recipient verification.Recipient, log *slog.Logger) {
+	background.Go(func() {
+		ctx, cancel := context.WithTimeout(ctx, mail.Timeout)
+
+		defer cancel()
+
+		if err := verification.Send(ctx, sender, conf, recipient); err != nil {
+			log.Error("Failed to send verification mail", "error", err)
+		}
+	})
+}
+
+// UserExists find if user exists based on username or email, regardless of
+// case
+func UserExists(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 		params := mux.Vars(request)
 
-		collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		collection := db.Collection("users")
+		ctx, cancel := database.Query(request.Context())
 
 		defer cancel()
 
@@ -304,15 +401,14 @@ func UserExists(db *mongo.Client) func(response http.ResponseWriter, request *ht
 
 		if params["type"] == "username" {
 			match = bson.D{
-				primitive.E{Key: "$match", Value: bson.D{primitive.E{Key: "username", Value: params["query"]}}},
+				primitive.E{Key: "$match", Value: UsernameFilter(params["query"])},
 			}
 		} else if params["type"] == "email" {
 			match = bson.D{
-				primitive.E{Key: "$match", Value: bson.D{primitive.E{Key: "email", Value: params["query"]}}},
+				primitive.E{Key: "$match", Value: EmailFilter(params["query"])},
 			}
 		} else {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "Unknown Parameter Type" }`))
+			apierror.Write(response, request, apierror.InvalidParameter)
 			return
 		}
 
@@ -324,18 +420,18 @@ func UserExists(db *mongo.Client) func(response http.ResponseWriter, request *ht
 				},
 			},
 		}
-		opts := options.Aggregate().SetMaxTime(2 * time.Second)
+		opts := database.Aggregate()
 
 		cursor, err := collection.Aggregate(ctx, mongo.Pipeline{match, project}, opts)
 		if err != nil {
-			response.WriteHeader(http.StatusInternalServerError)
-			response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+			apierror.WriteError(response, request, err)
 			return
 		}
 
 		var results []bson.M
-		if err = cursor.All(context.TODO(), &results); err != nil {
-			log.Fatal(err)
+		if err = cursor.All(ctx, &results); err != nil {
+			apierror.WriteError(response, request, err)
+			return
 		}
 
 		if len(results) > 0 {
@@ -346,8 +442,70 @@ func UserExists(db *mongo.Client) func(response http.ResponseWriter, request *ht
 	}
 }
 
+// Followers fetch followers of given user
+func Followers(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+		params := mux.Vars(request)
+
+		id, err := primitive.ObjectIDFromHex(params["id"])
+		if err != nil {
+			apierror.Write(response, request, apierror.InvalidID)
+			return
+		}
+		page, err := pagination.FromRequest(request, edges.ListLimit, edges.NewestFirst)
+		if err != nil {
+			apierror.Write(response, request, apierror.InvalidPage)
+			return
+		}
+
+		_, _, ok := request.BasicAuth()
+
+		if ok {
+			results, err := edges.Users(request.Context(), db, edges.Follow, edges.Follow.To, id, page)
+			if err != nil {
+				apierror.WriteError(response, request, err)
+				return
+			}
+
+			page.Write(response, results)
+		}
+	}
+}
+
+// Following fetch users given user follows
+func Following(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+		params := mux.Vars(request)
+
+		id, err := primitive.ObjectIDFromHex(params["id"])
+		if err != nil {
+			apierror.Write(response, request, apierror.InvalidID)
+			return
+		}
+		page, err := pagination.FromRequest(request, edges.ListLimit, edges.NewestFirst)
+		if err != nil {
+			apierror.Write(response, request, apierror.InvalidPage)
+			return
+		}
+
+		_, _, ok := request.BasicAuth()
+
+		if ok {
+			results, err := edges.Users(request.Context(), db, edges.Follow, edges.Follow.From, id, page)
+			if err != nil {
+				apierror.WriteError(response, request, err)
+				return
+			}
+
+			page.Write(response, results)
+		}
+	}
+}
+
 // UserAction is for following and unfollowing users
-func UserAction(db *mongo.Client) func(response http.ResponseWriter, request *http.Request) {
+func UserAction(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
 	return func(response http.ResponseWriter, request *http.Request) {
 		response.Header().Add("content-type", "application/json; charset=utf-8")
 		actionType := mux.Vars(request)["type"]
@@ -361,169 +519,133 @@ func UserAction(db *mongo.Client) func(response http.ResponseWriter, request *ht
 
 			if err == nil {
 				if actionType == "follow" {
-					follow(db, response, request, oID, action.ID)
+					setFollow(db, response, request, oID, action.ID, true)
 					return
 				} else if actionType == "unfollow" {
-					unfollow(db, response, request, oID, action.ID)
+					setFollow(db, response, request, oID, action.ID, false)
 					return
 				}
 			} else {
-				response.WriteHeader(http.StatusInternalServerError)
-				response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
+				apierror.Write(response, request, apierror.InvalidBody)
 				return
 			}
 
 		}
 
-		response.WriteHeader(http.StatusNotFound)
-		response.Write([]byte(`{ "message": "Not Found" }`))
+		apierror.Write(response, request, apierror.NotFound)
 		return
 	}
 }
 
-func follow(
-	db *mongo.Client,
-	response http.ResponseWriter,
-	request *http.Request,
-	followerID primitive.ObjectID,
-	followeeID primitive.ObjectID,
-) error {
-	if followerID != followeeID {
-		collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-
-		defer cancel()
-
-		results := followed(db, response, request, followerID, followeeID)
-
-		if len(results) > 0 {
-			if results[0]["followed"].(bool) {
-				response.WriteHeader(http.StatusBadRequest)
-				response.Write([]byte(`{ "message": "User already followed" }`))
-				return nil
-			}
-			updateOpts := options.FindOneAndUpdate().SetUpsert(true)
-
-			followeeFilter := bson.D{primitive.E{Key: "_id", Value: followeeID}}
-			followeeUpdate := bson.D{primitive.E{
-				Key: "$push", Value: bson.D{primitive.E{Key: "followers", Value: followerID}},
-			}}
-			collection.FindOneAndUpdate(ctx, followeeFilter, followeeUpdate, updateOpts)
-
-			followerFilter := bson.D{primitive.E{Key: "_id", Value: followerID}}
-			followerUpdate := bson.D{primitive.E{
-				Key: "$push", Value: bson.D{primitive.E{Key: "follows", Value: followeeID}},
-			}}
-			collection.FindOneAndUpdate(ctx, followerFilter, followerUpdate, updateOpts)
-
-			// Send notification
-			var follower, followee bson.M
+// Follow follows given user on PUT and unfollows on DELETE, repeated
+// requests leave the user as it is and respond the same
+func Follow(db *mongo.Database) func(response http.ResponseWriter, request *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+		params := mux.Vars(request)
 
-			opts := options.FindOne().SetProjection(bson.D{
-				primitive.E{Key: "fullname", Value: "$fullname"},
-				primitive.E{Key: "username", Value: "$username"},
-				primitive.E{Key: "language", Value: "$language"},
-			})
-			collection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: followerID}}, opts).Decode(&follower)
-			collection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: followeeID}}, opts).Decode(&followee)
+		id, err := primitive.ObjectIDFromHex(params["id"])
+		if err != nil {
+			apierror.Write(response, request, apierror.InvalidID)
+			return
+		}
 
-			notification.SendNotification(followeeID, messaging.Notification{
-				Title: config.Languages[followee["language"].(string)].NewFollow(),
-				Body:  config.Languages[followee["language"].(string)].FollowStart(follower["fullname"].(string) + " (@" + follower["username"].(string) + ")"),
-			}, db)
+		authID, _, ok := request.BasicAuth()
 
-			response.Write([]byte(`{ "message": "OK" }`))
-			return nil
+		if ok {
+			oID, _ := primitive.ObjectIDFromHex(authID)
+			setFollow(db, response, request, oID, id, request.Method == http.MethodPut)
 		}
-
-		response.WriteHeader(http.StatusNotFound)
-		response.Write([]byte(`{ "message": "User Not Found" }`))
-		return nil
 	}
-	return nil
 }
 
-func unfollow(
-	db *mongo.Client,
+// setFollow brings follow of followerID to followeeID to given state and
+// responds the resulting state of the followee
+func setFollow(
+	db *mongo.Database,
 	response http.ResponseWriter,
 	request *http.Request,
 	followerID primitive.ObjectID,
 	followeeID primitive.ObjectID,
-) error {
-	collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-
-	defer cancel()
-
-	results := followed(db, response, request, followerID, followeeID)
-
-	if len(results) > 0 {
-		if results[0]["followed"].(bool) == false {
-			response.WriteHeader(http.StatusBadRequest)
-			response.Write([]byte(`{ "message": "User already unfollowed" }`))
-			return nil
-		}
-		updateOpts := options.FindOneAndUpdate().SetUpsert(true)
-
-		followeeFilter := bson.D{primitive.E{Key: "_id", Value: followeeID}}
-		followeeUpdate := bson.D{primitive.E{
-			Key: "$pull", Value: bson.D{primitive.E{Key: "followers", Value: followerID}},
-		}}
-		collection.FindOneAndUpdate(ctx, followeeFilter, followeeUpdate, updateOpts)
-
-		followerFilter := bson.D{primitive.E{Key: "_id", Value: followerID}}
-		followerUpdate := bson.D{primitive.E{
-			Key: "$pull", Value: bson.D{primitive.E{Key: "follows", Value: followeeID}},
-		}}
-		collection.FindOneAndUpdate(ctx, followerFilter, followerUpdate, updateOpts)
-
-		response.Write([]byte(`{ "message": "OK" }`))
-		return nil
+	followed bool,
+) {
+	if followerID == followeeID {
+		apierror.Write(response, request, apierror.SelfFollow)
+		return
 	}
 
-	response.WriteHeader(http.StatusNotFound)
-	response.Write([]byte(`{ "message": "User Not Found" }`))
-	return nil
-}
-
-func followed(
-	db *mongo.Client,
-	response http.ResponseWriter,
-	request *http.Request,
-	followerID primitive.ObjectID,
-	followeeID primitive.ObjectID,
-) []bson.M {
-	collection := db.Database(os.Getenv("DATABASE_NAME")).Collection("users")
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	collection := db.Collection("users")
+	ctx, cancel := database.Query(request.Context())
 
 	defer cancel()
 
-	aggregateOpts := options.Aggregate().SetMaxTime(2 * time.Second)
-	match := bson.D{
-		primitive.E{Key: "$match", Value: bson.D{primitive.E{Key: "_id", Value: followeeID}}},
+	changed, err := edges.Set(
+		request.Context(),
+		db,
+		edges.Follow,
+		followerID,
+		followeeID,
+		followed,
+		edges.Counter{Collection: "users", ID: followeeID, Field: "followerCount"},
+		edges.Counter{Collection: "users", ID: followerID, Field: "followCount"},
+	)
+	if err == edges.ErrNotFound {
+		apierror.Write(response, request, apierror.UserNotFound)
+		return
 	}
-	project := bson.D{
-		primitive.E{
-			Key: "$project",
-			Value: bson.D{
-				primitive.E{Key: "followed", Value: bson.D{
-					primitive.E{Key: "$in", Value: []interface{}{followerID, "$followers"}},
-				}},
-			},
-		},
+	if err != nil {
+		apierror.WriteError(response, request, err)
+		return
 	}
-	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{match, project}, aggregateOpts)
 
+	var followee bson.M
+	opts := options.FindOne().SetProjection(bson.D{
+		primitive.E{Key: "followerCount", Value: "$followerCount"},
+		primitive.E{Key: "language", Value: "$language"},
+	})
+	err = collection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: followeeID}}, opts).Decode(&followee)
+	if err == mongo.ErrNoDocuments {
+		apierror.Write(response, request, apierror.UserNotFound)
+		return
+	}
 	if err != nil {
-		response.WriteHeader(http.StatusInternalServerError)
-		response.Write([]byte(`{ "message": "` + err.Error() + `" }`))
-		return nil
+		apierror.WriteError(response, request, err)
+		return
 	}
 
-	var results []bson.M
-	if err = cursor.All(ctx, &results); err != nil {
-		log.Fatal(err)
+	if changed {
+		// The follow changed, timelines must follow it even if the client is gone
+		followup := context.WithoutCancel(request.Context())
+
+		if err := timeline.UpdatePopularity(followup, db, followeeID); err != nil {
+			logger.FromRequest(request).Error("Failed to update popularity", "error", err)
+		}
+
+		if followed {
+			if err := timeline.Backfill(followup, db, followerID, followeeID); err != nil {
+				logger.FromRequest(request).Error("Failed to backfill timeline", "error", err)
+			}
+
+			// Send notification
+			var follower bson.M
+
+			opts := options.FindOne().SetProjection(bson.D{
+				primitive.E{Key: "fullname", Value: "$fullname"},
+				primitive.E{Key: "username", Value: "$username"},
+			})
+			collection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: followerID}}, opts).Decode(&follower)
+
+			notification.SendNotification(request.Context(), followeeID, messaging.Notification{
+				Title: config.Languages[followee["language"].(string)].NewFollow(),
+				Body:  config.Languages[followee["language"].(string)].FollowStart(follower["fullname"].(string) + " (@" + follower["username"].(string) + ")"),
+			}, db)
+		} else if err := timeline.RemoveAuthor(followup, db, followerID, followeeID); err != nil {
+			logger.FromRequest(request).Error("Failed to clean up timeline", "error", err)
+		}
 	}
 
-	return results
+	json.NewEncoder(response).Encode(bson.M{
+		"followed":  followed,
+		"followers": followee["followerCount"],
+	})
 }
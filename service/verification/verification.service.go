@@ -0,0 +1,211 @@
+package verification
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jt-api/apierror"
+	"jt-api/config"
+	"jt-api/database"
+	"jt-api/logger"
+	"jt-api/mail"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// purpose is signed into verification tokens and their key is derived from
+// it, so they can not pass as auth tokens or the other way round
+const purpose = "verify_email"
+
+type claims struct {
+	Purpose string `json:"purpose"`
+	Email   string `json:"email"`
+	jwt.StandardClaims
+}
+
+// VerifyRequest is the body of an email verification
+type VerifyRequest struct {
+	Token string `json:"token,omitempty"`
+}
+
+// key returns the signing key of verification tokens
+func key(conf config.Server) []byte {
+	mac := hmac.New(sha256.New, []byte(conf.JWTSecret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// Token returns a token verifying email of user that expires after
+// EmailVerificationTTL, the email is signed in so the token is void once the
+// user changes it
+func Token(conf config.Server, userID primitive.ObjectID, email string) (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims{
+		Purpose: purpose,
+		Email:   email,
+		StandardClaims: jwt.StandardClaims{
+			Subject:   userID.Hex(),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(conf.EmailVerificationTTL).Unix(),
+		},
+	})
+	return token.SignedString(key(conf))
+}
+
+// parse returns the user and the email verified by token
+func parse(conf config.Server, token string) (primitive.ObjectID, string, error) {
+	var parsed claims
+	_, err := jwt.ParseWithClaims(token, &parsed, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		return key(conf), nil
+	})
+	if err != nil {
+		return primitive.NilObjectID, "", err
+	}
+	if parsed.Purpose != purpose {
+		return primitive.NilObjectID, "", errors.New("Token is not an email verification token")
+	}
+
+	userID, err := primitive.ObjectIDFromHex(parsed.Subject)
+	return userID, parsed.Email, err
+}
+
+// Recipient is the user a verification link is mailed to
+type Recipient struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	Email      string             `bson:"email"`
+	EmailLower string             `bson:"emailLower"`
+	Language   string             `bson:"language"`
+}
+
+// Send mails recipient a link verifying their email in their language
+func Send(ctx context.Context, sender mail.Sender, conf config.Server, recipient Recipient) error {
+	token, err := Token(conf, recipient.ID, recipient.EmailLower)
+	if err != nil {
+		return err
+	}
+
+	texts, ok := config.Languages[recipient.Language]
+	if !ok {
+		texts = config.Languages[apierror.DefaultLanguage]
+	}
+
+	link := conf.AppURL + "/verify-email?token=" + url.QueryEscape(token)
+	return sender.Send(ctx, mail.Message{
+		To:      recipient.Email,
+		Subject: texts.VerifyEmail(),
+		Body:    texts.VerifyEmailAt(link),
+	})
+}
+
+// VerifyEmail marks the email in the token as verified, a token is only
+// accepted once and a token of an email the user no longer has is rejected
+func VerifyEmail(db *mongo.Database, conf config.Server) func(response http.ResponseWriter, request *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+
+		var body VerifyRequest
+		if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+			apierror.Write(response, request, apierror.InvalidBody)
+			return
+		}
+		if body.Token == "" {
+			apierror.Write(response, request, apierror.MissingFields)
+			return
+		}
+
+		userID, email, err := parse(conf, body.Token)
+		if err != nil {
+			apierror.Write(response, request, apierror.InvalidToken)
+			return
+		}
+
+		collection := db.Collection("users")
+		ctx, cancel := database.Query(request.Context())
+
+		defer cancel()
+
+		result, err := collection.UpdateOne(ctx, bson.D{
+			primitive.E{Key: "_id", Value: userID},
+			primitive.E{Key: "emailLower", Value: email},
+			primitive.E{Key: "emailVerified", Value: bson.D{primitive.E{Key: "$ne", Value: true}}},
+		}, bson.D{primitive.E{Key: "$set", Value: bson.D{
+			primitive.E{Key: "emailVerified", Value: true},
+		}}})
+		if err != nil {
+			apierror.WriteError(response, request, err)
+			return
+		}
+		if result.MatchedCount == 0 {
+			apierror.Write(response, request, apierror.InvalidToken)
+			return
+		}
+
+		response.Write([]byte(`{ "message": "OK" }`))
+	}
+}
+
+// Resend mails the authenticated user a new verification link
+func Resend(db *mongo.Database, conf config.Server, sender mail.Sender) func(response http.ResponseWriter, request *http.Request) {
+	return func(response http.ResponseWriter, request *http.Request) {
+		response.Header().Add("content-type", "application/json; charset=utf-8")
+
+		authID, _, _ := request.BasicAuth()
+		id, _ := primitive.ObjectIDFromHex(authID)
+
+		collection := db.Collection("users")
+		ctx, cancel := database.Query(request.Context())
+
+		defer cancel()
+
+		var user struct {
+			Recipient     `bson:",inline"`
+			EmailVerified bool `bson:"emailVerified"`
+		}
+		opts := options.FindOne().SetProjection(bson.D{
+			primitive.E{Key: "email", Value: 1},
+			primitive.E{Key: "emailLower", Value: 1},
+			primitive.E{Key: "emailVerified", Value: 1},
+			primitive.E{Key: "language", Value: 1},
+		})
+		err := collection.FindOne(ctx, bson.D{primitive.E{Key: "_id", Value: id}}, opts).Decode(&user)
+		if err != nil {
+			if errors.Is(err, mongo.ErrNoDocuments) {
+				err = apierror.New(apierror.UserNotFound)
+			}
+			apierror.WriteError(response, request, err)
+			return
+		}
+
+		if user.EmailVerified {
+			apierror.Write(response, request, apierror.EmailVerified)
+			return
+		}
+		// Users that signed up before canonical emails were migrated have
+		// none, verifying them waits for the migration
+		if user.EmailLower == "" {
+			apierror.Write(response, request, apierror.NotFound)
+			return
+		}
+
+		if err = Send(request.Context(), sender, conf, user.Recipient); err != nil {
+			logger.FromRequest(request).Error("Failed to send verification mail", "error", err)
+			apierror.Write(response, request, apierror.Internal)
+			return
+		}
+
+		response.Write([]byte(`{ "message": "OK" }`))
+	}
+}
@@ -0,0 +1,214 @@
+package verification_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"jt-api/apierror"
+	"jt-api/config"
+	"jt-api/mail"
+	"jt-api/service/users"
+	"jt-api/service/verification"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var linkToken = regexp.MustCompile(`/verify-email\?token=(\S+)`)
+
+// smtpSink accepts mails on a local port and hands their data over, it speaks
+// just enough SMTP for mail.SMTPSender
+func smtpSink(t *testing.T) (string, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	messages := make(chan string, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSMTP(conn, messages)
+		}
+	}()
+
+	return listener.Addr().String(), messages
+}
+
+func serveSMTP(conn net.Conn, messages chan<- string) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+
+	reply("220 localhost")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		switch command := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "DATA"):
+			reply("354 End data with <CR><LF>.<CR><LF>")
+
+			var data strings.Builder
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(line, "."))
+			}
+			messages <- data.String()
+			reply("250 OK")
+		case strings.HasPrefix(command, "QUIT"):
+			reply("221 Bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+// testDatabase connects to TEST_DB_CONN_STR and returns a database of its own
+// that is dropped once the test ends
+func testDatabase(t *testing.T) *mongo.Database {
+	uri := os.Getenv("TEST_DB_CONN_STR")
+	if uri == "" {
+		t.Skip("TEST_DB_CONN_STR is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db := client.Database("jt_test_" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+		defer cancel()
+
+		db.Drop(ctx)
+		client.Disconnect(ctx)
+	})
+
+	return db
+}
+
+func post(handler http.HandlerFunc, body interface{}) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(data)))
+	response := httptest.NewRecorder()
+	handler(response, request)
+	return response
+}
+
+func code(response *httptest.ResponseRecorder) apierror.Code {
+	var body apierror.Response
+	json.NewDecoder(response.Body).Decode(&body)
+	return body.Code
+}
+
+func TestSignupVerificationLink(t *testing.T) {
+	db := testDatabase(t)
+	address, messages := smtpSink(t)
+
+	conf := config.Defaults
+	conf.JWTSecret = "test-secret"
+	conf.AppURL = "https://app.example.com"
+	conf.SMTPAddress = address
+	conf.MailFrom = "noreply@example.com"
+	conf.EmailVerificationTTL = time.Hour
+
+	signup := post(users.CreateUser(db, conf, mail.New(conf)), map[string]interface{}{
+		"fullname": "Test User",
+		"username": "tester",
+		"email":    "Tester@Example.com",
+		"password": "secret123",
+	})
+	if signup.Code != http.StatusOK {
+		t.Fatalf("signup status %d: %s", signup.Code, signup.Body)
+	}
+
+	var created struct {
+		InsertedID primitive.ObjectID `json:"InsertedID"`
+	}
+	if err := json.NewDecoder(signup.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+
+	var message string
+	select {
+	case message = <-messages:
+	case <-time.After(10 * time.Second):
+		t.Fatal("no verification mail delivered")
+	}
+
+	if !strings.Contains(message, "To: Tester@Example.com\r\n") {
+		t.Errorf("mail not sent to the signup email:\n%s", message)
+	}
+	match := linkToken.FindStringSubmatch(message)
+	if match == nil {
+		t.Fatalf("no verification link in mail:\n%s", message)
+	}
+	token, err := url.QueryUnescape(match[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verify := verification.VerifyEmail(db, conf)
+
+	expired := conf
+	expired.EmailVerificationTTL = -time.Minute
+	expiredToken, err := verification.Token(expired, created.InsertedID, "tester@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response := post(verify, verification.VerifyRequest{Token: expiredToken}); code(response) != apierror.InvalidToken {
+		t.Errorf("expired token: status %d, %s", response.Code, response.Body)
+	}
+
+	if response := post(verify, verification.VerifyRequest{Token: token}); response.Code != http.StatusOK {
+		t.Fatalf("mailed token: status %d, %s", response.Code, response.Body)
+	}
+
+	var user users.User
+	err = db.Collection("users").FindOne(context.Background(), bson.D{primitive.E{Key: "_id", Value: created.InsertedID}}).Decode(&user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.EmailVerified {
+		t.Error("email not verified")
+	}
+
+	if response := post(verify, verification.VerifyRequest{Token: token}); code(response) != apierror.InvalidToken {
+		t.Errorf("reused token: status %d, %s", response.Code, response.Body)
+	}
+}
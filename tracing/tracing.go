@@ -0,0 +1,174 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"jt-api/config"
+	"jt-api/requestinfo"
+	"net/http"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("jt-api")
+
+// Init installs the tracer provider exporting to the configured exporter, the
+// returned function flushes pending spans and must be called on shutdown
+//
+// With the none exporter spans are still created so trace IDs are propagated
+// and logged, they are just not exported
+func Init(conf config.Server) (func(ctx context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName("jt-api"),
+			semconv.DeploymentEnvironment(conf.Env),
+		)),
+	}
+
+	switch conf.TraceExporter {
+	case "stdout":
+		exporter, err := stdouttrace.New()
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, sdktrace.WithBatcher(exporter))
+	case "otlp":
+		exporter, err := otlptracehttp.New(
+			context.Background(),
+			otlptracehttp.WithEndpoint(conf.TraceEndpoint),
+			otlptracehttp.WithInsecure(),
+		)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+
+	provider := sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Start starts a span as a child of the span in ctx
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err on the span, if any, and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TraceID returns the ID of the trace in ctx, empty when there is none
+func TraceID(ctx context.Context) string {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.HasTraceID() {
+		return ""
+	}
+	return spanContext.TraceID().String()
+}
+
+// Middleware starts a span for every request, continuing the trace of the
+// caller when it sends traceparent header, the span is named after the route
+// template resolved by requestinfo.Middleware
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(request.Context(), propagation.HeaderCarrier(request.Header))
+		info := requestinfo.From(request)
+
+		ctx, span := tracer.Start(
+			ctx,
+			request.Method+" "+info.Route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(request.Method),
+				semconv.HTTPRoute(info.Route),
+				semconv.URLPath(request.URL.Path),
+			),
+		)
+
+		defer span.End()
+
+		next.ServeHTTP(response, request.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(info.Status))
+		if info.Status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(info.Status))
+		}
+	})
+}
+
+// CommandMonitor traces MongoDB commands as children of the span in the
+// context of the operation, then passes events on to next
+func CommandMonitor(next *event.CommandMonitor) *event.CommandMonitor {
+	var spans sync.Map
+
+	key := func(connectionID string, requestID int64) string {
+		return fmt.Sprintf("%s/%d", connectionID, requestID)
+	}
+
+	return &event.CommandMonitor{
+		Started: func(ctx context.Context, started *event.CommandStartedEvent) {
+			attrs := []attribute.KeyValue{
+				semconv.DBSystemMongoDB,
+				semconv.DBNamespace(started.DatabaseName),
+				semconv.DBOperationName(started.CommandName),
+			}
+			if collection, ok := started.Command.Lookup(started.CommandName).StringValueOK(); ok {
+				attrs = append(attrs, semconv.DBCollectionName(collection))
+			}
+
+			_, span := tracer.Start(
+				ctx,
+				"mongo."+started.CommandName,
+				trace.WithSpanKind(trace.SpanKindClient),
+				trace.WithAttributes(attrs...),
+			)
+			spans.Store(key(started.ConnectionID, started.RequestID), span)
+
+			if next != nil && next.Started != nil {
+				next.Started(ctx, started)
+			}
+		},
+		Succeeded: func(ctx context.Context, succeeded *event.CommandSucceededEvent) {
+			if span, ok := spans.LoadAndDelete(key(succeeded.ConnectionID, succeeded.RequestID)); ok {
+				span.(trace.Span).End()
+			}
+
+			if next != nil && next.Succeeded != nil {
+				next.Succeeded(ctx, succeeded)
+			}
+		},
+		Failed: func(ctx context.Context, failed *event.CommandFailedEvent) {
+			if span, ok := spans.LoadAndDelete(key(failed.ConnectionID, failed.RequestID)); ok {
+				End(span.(trace.Span), errors.New(failed.Failure))
+			}
+
+			if next != nil && next.Failed != nil {
+				next.Failed(ctx, failed)
+			}
+		},
+	}
+}
@@ -0,0 +1,241 @@
+package validation
+
+import (
+	"fmt"
+	"jt-api/apierror"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rules are declared on struct fields with the validate tag, for example
+// `validate:"required,min=3,max=20,username"`. Rules other than required are
+// skipped for empty values so partial updates can share the same rules.
+const tagName = "validate"
+
+// Password limits, bcrypt ignores anything after 72 bytes
+const (
+	PasswordMinLength = 8
+	PasswordMaxLength = 72
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.]+$`)
+
+type rule func(value reflect.Value, param string) bool
+
+var rules = map[string]rule{
+	"required": func(value reflect.Value, param string) bool {
+		return !isEmpty(value)
+	},
+	"min": func(value reflect.Value, param string) bool {
+		limit, _ := strconv.Atoi(param)
+		return length(value) >= limit
+	},
+	"max": func(value reflect.Value, param string) bool {
+		limit, _ := strconv.Atoi(param)
+		return length(value) <= limit
+	},
+	"username": func(value reflect.Value, param string) bool {
+		return usernamePattern.MatchString(value.String())
+	},
+	"email": func(value reflect.Value, param string) bool {
+		address, err := mail.ParseAddress(value.String())
+		return err == nil && address.Address == value.String() && strings.Contains(address.Address, ".")
+	},
+	"password": func(value reflect.Value, param string) bool {
+		password := value.String()
+		if len(password) < PasswordMinLength || len(password) > PasswordMaxLength {
+			return false
+		}
+
+		var letter, digit bool
+		for _, char := range password {
+			letter = letter || unicode.IsLetter(char)
+			digit = digit || unicode.IsDigit(char)
+		}
+		return letter && digit
+	},
+}
+
+// field is a struct field that has rules, or whose fields are checked in
+// turn when it dives
+type field struct {
+	index int
+	name  string
+	dive  bool
+	rules []boundRule
+}
+
+type boundRule struct {
+	name  string
+	param string
+	apply rule
+}
+
+type parsed struct {
+	fields []field
+	err    error
+}
+
+// parsedTypes caches the fields of every struct type checked so far
+var parsedTypes sync.Map
+
+// Struct checks the fields of given struct against their rules and returns a
+// validation_failed error listing every failing field, or nil
+//
+// Tags are parsed once per struct type, a tag naming an unknown rule is
+// returned as an error on every check of the type instead of a panic
+func Struct(value interface{}) error {
+	fields, err := check(reflect.ValueOf(value), "", nil)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+
+	return &apierror.Error{Code: apierror.ValidationFailed, Fields: fields}
+}
+
+func check(value reflect.Value, prefix string, failed []apierror.FieldError) ([]apierror.FieldError, error) {
+	for value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return failed, nil
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return failed, nil
+	}
+
+	fields, err := fieldsOf(value.Type())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range fields {
+		name := prefix + field.name
+		fieldValue := value.Field(field.index)
+
+		if field.dive {
+			if failed, err = check(fieldValue, name+".", failed); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		for _, bound := range field.rules {
+			if bound.name != "required" && isEmpty(fieldValue) {
+				continue
+			}
+			if !bound.apply(indirect(fieldValue), bound.param) {
+				failed = append(failed, apierror.FieldError{Field: name, Rule: bound.name, Param: bound.param})
+				break
+			}
+		}
+	}
+
+	return failed, nil
+}
+
+// fieldsOf returns the fields of given struct type that have rules
+func fieldsOf(structType reflect.Type) ([]field, error) {
+	if cached, ok := parsedTypes.Load(structType); ok {
+		result := cached.(parsed)
+		return result.fields, result.err
+	}
+
+	fields, err := parse(structType)
+	parsedTypes.Store(structType, parsed{fields: fields, err: err})
+	return fields, err
+}
+
+func parse(structType reflect.Type) ([]field, error) {
+	fields := []field{}
+	for i := 0; i < structType.NumField(); i++ {
+		structField := structType.Field(i)
+		if structField.PkgPath != "" {
+			continue
+		}
+
+		tag, ok := structField.Tag.Lookup(tagName)
+		if !ok {
+			continue
+		}
+		if tag == "dive" {
+			fields = append(fields, field{index: i, name: fieldName(structField), dive: true})
+			continue
+		}
+
+		parsedField := field{index: i, name: fieldName(structField)}
+		for _, declaration := range strings.Split(tag, ",") {
+			ruleName, param := declaration, ""
+			if index := strings.Index(declaration, "="); index >= 0 {
+				ruleName, param = declaration[:index], declaration[index+1:]
+			}
+
+			apply, ok := rules[ruleName]
+			if !ok {
+				return nil, fmt.Errorf("validation: unknown rule %s on %s.%s", ruleName, structType, structField.Name)
+			}
+			if ruleName == "min" || ruleName == "max" {
+				if _, err := strconv.Atoi(param); err != nil {
+					return nil, fmt.Errorf("validation: %s of %s.%s is not a number", ruleName, structType, structField.Name)
+				}
+			}
+
+			parsedField.rules = append(parsedField.rules, boundRule{name: ruleName, param: param, apply: apply})
+		}
+		fields = append(fields, parsedField)
+	}
+
+	return fields, nil
+}
+
+// fieldName returns the name the field is known by in request bodies
+func fieldName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		return field.Name
+	}
+	return name
+}
+
+func indirect(value reflect.Value) reflect.Value {
+	for value.Kind() == reflect.Ptr && !value.IsNil() {
+		value = value.Elem()
+	}
+	return value
+}
+
+func isEmpty(value reflect.Value) bool {
+	value = indirect(value)
+	switch value.Kind() {
+	case reflect.Ptr:
+		return value.IsNil()
+	case reflect.String:
+		return strings.TrimSpace(value.String()) == ""
+	case reflect.Slice, reflect.Map:
+		return value.Len() == 0
+	default:
+		return value.IsZero()
+	}
+}
+
+// length counts characters of strings and elements of slices
+func length(value reflect.Value) int {
+	value = indirect(value)
+	switch value.Kind() {
+	case reflect.String:
+		return utf8.RuneCountInString(value.String())
+	case reflect.Slice, reflect.Map, reflect.Array:
+		return value.Len()
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,38 @@
+package views
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// Content is the block list of posts and comments, its shape is up to the
+// clients
+//
+// Documents in an interface slice are decoded as bson.D by default, which is
+// encoded to JSON as a list of key value pairs, so blocks are decoded as maps
+type Content []interface{}
+
+// UnmarshalBSONValue decodes content through a bson.M so nested documents
+// become maps
+func (content *Content) UnmarshalBSONValue(valueType bsontype.Type, data []byte) error {
+	if valueType == bsontype.Null || valueType == bsontype.Undefined {
+		*content = nil
+		return nil
+	}
+
+	document := bsoncore.BuildDocument(nil, bsoncore.AppendValueElement(nil, "content", bsoncore.Value{
+		Type: valueType,
+		Data: data,
+	}))
+
+	var wrapper bson.M
+	if err := bson.Unmarshal(document, &wrapper); err != nil {
+		return err
+	}
+
+	blocks, _ := wrapper["content"].(primitive.A)
+	*content = Content(blocks)
+	return nil
+}
@@ -0,0 +1,138 @@
+package views
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// UserSummary is the public part of a user shown next to content
+type UserSummary struct {
+	ID       primitive.ObjectID `json:"_id" bson:"_id"`
+	Fullname string             `json:"fullname" bson:"fullname"`
+	Username string             `json:"username" bson:"username"`
+	Image    string             `json:"image" bson:"image"`
+	Verified bool               `json:"verified" bson:"verified"`
+}
+
+// CommunitySummary is the public part of a community shown next to content
+type CommunitySummary struct {
+	ID    primitive.ObjectID `json:"_id" bson:"_id"`
+	Title string             `json:"title" bson:"title"`
+	Image string             `json:"image" bson:"image"`
+}
+
+// CommunityView is a community as it is listed and shown on its own page,
+// listings leave bio, banner and founder out
+type CommunityView struct {
+	CommunitySummary `bson:",inline"`
+
+	Bio     string       `json:"bio,omitempty" bson:"bio,omitempty"`
+	Banner  string       `json:"banner,omitempty" bson:"banner,omitempty"`
+	Founder *UserSummary `json:"founder,omitempty" bson:"founder,omitempty"`
+	Members int          `json:"members" bson:"members"`
+	Joined  bool         `json:"joined" bson:"joined"`
+}
+
+// PostView is a post as it is served to clients, hot and rising scores are
+// carried so cursors of listings sorted by them can be built
+type PostView struct {
+	ID        primitive.ObjectID `json:"_id" bson:"_id"`
+	Title     string             `json:"title" bson:"title"`
+	Content   Content            `json:"content" bson:"content"`
+	Images    []string           `json:"images" bson:"images"`
+	Tags      []string           `json:"tags" bson:"tags"`
+	Date      primitive.DateTime `json:"date" bson:"date"`
+	Author    *UserSummary       `json:"author" bson:"author"`
+	Community *CommunitySummary  `json:"community,omitempty" bson:"community,omitempty"`
+	Upvotes   int                `json:"upvotes" bson:"upvotes"`
+	Answers   int                `json:"answers" bson:"answers"`
+	Upvoted   bool               `json:"upvoted" bson:"upvoted"`
+	Hot       float64            `json:"hot,omitempty" bson:"hot"`
+	Rising    float64            `json:"rising,omitempty" bson:"rising"`
+}
+
+// CommentView is a comment as it is served to clients
+type CommentView struct {
+	ID      primitive.ObjectID `json:"_id" bson:"_id"`
+	Post    primitive.ObjectID `json:"post" bson:"post"`
+	Content Content            `json:"content" bson:"content"`
+	Date    primitive.DateTime `json:"date" bson:"date"`
+	Author  *UserSummary       `json:"author" bson:"author"`
+	Upvotes int                `json:"upvotes" bson:"upvotes"`
+	Answers int                `json:"answers" bson:"answers"`
+	Upvoted bool               `json:"upvoted" bson:"upvoted"`
+}
+
+// PostFields projects a post document into the fields of PostView, author and
+// community are left as IDs to be hydrated by LookupUser and LookupCommunity
+var PostFields = bson.D{
+	primitive.E{Key: "_id", Value: "$_id"},
+	primitive.E{Key: "community", Value: "$community"},
+	primitive.E{Key: "images", Value: "$images"},
+	primitive.E{Key: "tags", Value: "$tags"},
+	primitive.E{Key: "title", Value: "$title"},
+	primitive.E{Key: "content", Value: "$content"},
+	primitive.E{Key: "date", Value: "$date"},
+	primitive.E{Key: "author", Value: "$author"},
+	primitive.E{Key: "answers", Value: "$answerCount"},
+	primitive.E{Key: "upvotes", Value: "$upvoteCount"},
+	primitive.E{Key: "hot", Value: "$hot"},
+	primitive.E{Key: "rising", Value: "$rising"},
+}
+
+var userSummaryFields = bson.D{
+	primitive.E{Key: "_id", Value: 1},
+	primitive.E{Key: "fullname", Value: 1},
+	primitive.E{Key: "username", Value: 1},
+	primitive.E{Key: "image", Value: 1},
+	primitive.E{Key: "verified", Value: 1},
+}
+
+var communitySummaryFields = bson.D{
+	primitive.E{Key: "_id", Value: 1},
+	primitive.E{Key: "title", Value: 1},
+	primitive.E{Key: "image", Value: 1},
+}
+
+// LookupUser returns the stages replacing the user ID in field with the
+// summary of the user, the field is removed when the user does not exist
+func LookupUser(field string) []bson.D {
+	return lookup("users", field, userSummaryFields)
+}
+
+// LookupCommunity returns the stages replacing the community ID in field
+// with the summary of the community
+func LookupCommunity(field string) []bson.D {
+	return lookup("communities", field, communitySummaryFields)
+}
+
+func lookup(collection string, field string, fields bson.D) []bson.D {
+	lookup := bson.D{
+		primitive.E{
+			Key: "$lookup",
+			Value: bson.D{
+				primitive.E{Key: "from", Value: collection},
+				primitive.E{Key: "let", Value: bson.D{primitive.E{Key: "id", Value: "$" + field}}},
+				primitive.E{Key: "pipeline", Value: []bson.D{
+					{primitive.E{Key: "$match", Value: bson.D{primitive.E{Key: "$expr", Value: bson.D{
+						primitive.E{Key: "$eq", Value: []interface{}{"$_id", "$$id"}},
+					}}}}},
+					{primitive.E{Key: "$project", Value: fields}},
+				}},
+				primitive.E{Key: "as", Value: field},
+			},
+		},
+	}
+
+	unwind := bson.D{
+		primitive.E{
+			Key: "$unwind",
+			Value: bson.D{
+				primitive.E{Key: "path", Value: "$" + field},
+				primitive.E{Key: "preserveNullAndEmptyArrays", Value: true},
+			},
+		},
+	}
+
+	return []bson.D{lookup, unwind}
+}